@@ -0,0 +1,317 @@
+// Package agent keeps a local directory in sync with a branch of a Konfigraf
+// repository for applications that read their configuration from files.
+package agent
+
+import (
+	"archive/tar"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/service"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/lib/pq"
+)
+
+// DefaultInterval is the default time between checks for changes
+const DefaultInterval = 30 * time.Second
+
+// Options configures what is synced and where to
+type Options struct {
+	// Repository name, required
+	Repository string
+	// Branch, tag or commit to sync, defaults to master
+	Branch string
+	// Path of the subtree to sync, defaults to the whole repository
+	Path string
+	// Dir is the local directory the files are written to, required
+	Dir string
+	// Command is run with sh -c after every update, optional. The new commit
+	// hash is available to it as KONFIGRAF_HASH.
+	Command string
+	// Interval between checks, defaults to DefaultInterval. When listening
+	// this is only a fallback in case a notification is missed.
+	Interval time.Duration
+	// Listen is a connection string used to LISTEN for commits so changes
+	// are synced immediately, only polling is used when empty
+	Listen string
+	// Logger for sync progress, defaults to the standard logger
+	Logger *log.Logger
+}
+
+// Agent syncs a directory with a repository
+type Agent struct {
+	db   *sql.DB
+	opts Options
+	hash string
+}
+
+// New creates an agent, the hash of the last sync is read back from disk so a
+// restarted agent does not rewrite an up to date directory
+func New(db *sql.DB, opts Options) *Agent {
+	if len(opts.Branch) == 0 {
+		opts.Branch = "master"
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(os.Stderr, "konfigraf: ", log.LstdFlags)
+	}
+
+	opts.Dir = filepath.Clean(opts.Dir)
+	a := &Agent{db: db, opts: opts}
+
+	hash, err := ioutil.ReadFile(a.hashFile())
+	if err == nil {
+		if _, err := os.Stat(opts.Dir); err == nil {
+			a.hash = strings.TrimSpace(string(hash))
+		}
+	}
+
+	return a
+}
+
+// Sync updates the directory if the branch has moved since the last sync and
+// runs the command, returning true if the directory was updated
+func (a *Agent) Sync() (bool, error) {
+	files, err := service.GetFiles(proxy.NewSQL(a.db), a.opts.Repository, a.opts.Branch, a.opts.Path, a.hash)
+	if err != nil {
+		return false, err
+	}
+
+	if files.NotModified {
+		return false, nil
+	}
+
+	var archive io.Reader = strings.NewReader("")
+	if files.File != nil {
+		archive = files.File
+	}
+
+	err = a.replace(archive)
+	if err != nil {
+		return false, err
+	}
+
+	a.hash = files.RepoHash
+	err = ioutil.WriteFile(a.hashFile(), []byte(a.hash+"\n"), 0644)
+	if err != nil {
+		return true, err
+	}
+
+	a.opts.Logger.Printf("synced %s to %s", a.opts.Dir, a.hash)
+
+	return true, a.runCommand()
+}
+
+// Run syncs the directory and keeps it in sync until the context is
+// cancelled, errors after the first sync are logged and retried
+func (a *Agent) Run(ctx context.Context) error {
+	_, err := a.Sync()
+	if err != nil {
+		return err
+	}
+
+	var notify <-chan *pq.Notification
+	if len(a.opts.Listen) > 0 {
+		listener := pq.NewListener(a.opts.Listen, time.Second, time.Minute, nil)
+		defer listener.Close()
+		err = listener.Listen(sqlstore.NotifyChannel)
+		if err != nil {
+			return err
+		}
+		notify = listener.Notify
+	}
+
+	ticker := time.NewTicker(a.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-notify:
+		case <-ticker.C:
+		}
+
+		_, err := a.Sync()
+		if err != nil {
+			a.opts.Logger.Printf("sync failed: %s", err)
+		}
+	}
+}
+
+// replace writes the archive to a new directory next to the target and
+// points the target, a symbolic link, at it. The link is swapped with a
+// rename so readers see either the old or the new files but never a
+// partially written set or a missing directory. A target that is still a
+// plain directory is moved aside the first time.
+func (a *Agent) replace(archive io.Reader) error {
+	parent, name := filepath.Split(a.opts.Dir)
+	if len(parent) == 0 {
+		parent = "."
+	}
+
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(parent, "."+name+".")
+	if err != nil {
+		return err
+	}
+
+	linked := false
+	defer func() {
+		if !linked {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	err = extract(archive, dir)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	previous, _ := os.Readlink(a.opts.Dir)
+
+	link := filepath.Join(parent, "."+name+".link")
+	err = os.Remove(link)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Symlink(filepath.Base(dir), link)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(link, a.opts.Dir)
+	if err != nil {
+		info, statErr := os.Lstat(a.opts.Dir)
+		if statErr != nil || !info.IsDir() {
+			return err
+		}
+
+		err = a.replaceDir(link)
+		if err != nil {
+			return err
+		}
+	}
+	linked = true
+
+	// only directories written by an earlier replace are removed
+	if len(previous) > 0 && previous == filepath.Base(previous) && strings.HasPrefix(previous, "."+name+".") {
+		return os.RemoveAll(filepath.Join(parent, previous))
+	}
+	return nil
+}
+
+// replaceDir replaces a target that is a plain directory with the link, the
+// directory is missing for a moment so this is only done once
+func (a *Agent) replaceDir(link string) error {
+	parent, name := filepath.Split(a.opts.Dir)
+	old := filepath.Join(parent, "."+name+".old")
+	err := os.RemoveAll(old)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(a.opts.Dir, old)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(link, a.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+func (a *Agent) hashFile() string {
+	parent, name := filepath.Split(a.opts.Dir)
+	return filepath.Join(parent, "."+name+".hash")
+}
+
+func (a *Agent) runCommand() error {
+	if len(a.opts.Command) == 0 {
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", a.opts.Command)
+	cmd.Env = append(os.Environ(), "KONFIGRAF_HASH="+a.hash)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("reload command failed: %w", err)
+	}
+	return nil
+}
+
+// extract writes the regular files of the archive below dir with their
+// permission bits, directories are created as they are needed and any other
+// entries are skipped
+func extract(archive io.Reader, dir string) error {
+	r := tar.NewReader(archive)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		target := filepath.Join(dir, name)
+		if !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(f, r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
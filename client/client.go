@@ -0,0 +1,228 @@
+// Package client loads configuration from a Konfigraf repository into memory
+// for applications, keeping it up to date as new commits are made.
+package client
+
+import (
+	"archive/tar"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/service"
+)
+
+// ErrFileNotFound is returned when a file is not part of the loaded subtree
+var ErrFileNotFound = fmt.Errorf("file not found")
+
+// Options configures what a client loads
+type Options struct {
+	// Repository name, required
+	Repository string
+	// Branch, tag or commit to load, defaults to master
+	Branch string
+	// Path of the subtree to load, defaults to the whole repository. File
+	// paths within the client are relative to this path.
+	Path string
+}
+
+// Change describes a file that was added, modified or removed by a refresh
+type Change struct {
+	Path string
+	// Old contents, nil if the file was added
+	Old []byte
+	// New contents, nil if the file was removed
+	New []byte
+}
+
+type handler struct {
+	pattern string
+	fn      func(Change)
+}
+
+// Client holds the files of a repository subtree in memory
+type Client struct {
+	db   *sql.DB
+	opts Options
+
+	// refresh serialises loads so changes are reported in order
+	refresh sync.Mutex
+
+	mu       sync.RWMutex
+	hash     string
+	files    map[string][]byte
+	handlers []handler
+}
+
+// New creates a client, call Load or Watch to read the files
+func New(db *sql.DB, opts Options) *Client {
+	if len(opts.Branch) == 0 {
+		opts.Branch = "master"
+	}
+
+	return &Client{
+		db:    db,
+		opts:  opts,
+		files: make(map[string][]byte),
+	}
+}
+
+// Load reads the files if the branch has moved since they were last read,
+// returning true if anything was loaded. Change handlers are called for every
+// file that differs from the previous load.
+func (c *Client) Load() (bool, error) {
+	c.refresh.Lock()
+	defer c.refresh.Unlock()
+
+	c.mu.RLock()
+	current := c.hash
+	c.mu.RUnlock()
+
+	result, err := service.GetFiles(proxy.NewSQL(c.db), c.opts.Repository, c.opts.Branch, c.opts.Path, current)
+	if err != nil {
+		return false, err
+	}
+
+	if result.NotModified {
+		return false, nil
+	}
+
+	files := make(map[string][]byte)
+	if result.File != nil {
+		files, err = readFiles(result.File)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	c.mu.Lock()
+	old := c.files
+	c.files = files
+	c.hash = result.RepoHash
+	handlers := c.handlers
+	c.mu.Unlock()
+
+	for _, change := range diffFiles(old, files) {
+		for _, h := range handlers {
+			if matchPath(h.pattern, change.Path) {
+				h.fn(change)
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Hash returns the commit hash the files were loaded from
+func (c *Client) Hash() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hash
+}
+
+// Files lists the paths of the loaded files
+func (c *Client) Files() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	result := make([]string, 0, len(c.files))
+	for p := range c.files {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// File returns the contents of a loaded file
+func (c *Client) File(name string) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	content, ok := c.files[cleanPath(name)]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return content, nil
+}
+
+// Decode unmarshals a loaded JSON file into v
+func (c *Client) Decode(name string, v interface{}) error {
+	content, err := c.File(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// OnChange registers a function called whenever a file matching the pattern
+// changes. Patterns use path.Match syntax, a pattern ending in /* also matches
+// everything below that directory and * alone matches every file.
+func (c *Client) OnChange(pattern string, fn func(Change)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, handler{cleanPath(pattern), fn})
+}
+
+func matchPath(pattern string, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func cleanPath(name string) string {
+	return strings.Trim(name, "/")
+}
+
+// readFiles reads every file in the archive into memory
+func readFiles(r io.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	archive := tar.NewReader(r)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+		files[cleanPath(hdr.Name)] = content
+	}
+}
+
+// diffFiles lists the changes between two sets of files ordered by path
+func diffFiles(old map[string][]byte, new map[string][]byte) []Change {
+	var changes []Change
+	for p, content := range new {
+		previous, ok := old[p]
+		if !ok || string(previous) != string(content) {
+			changes = append(changes, Change{Path: p, Old: previous, New: content})
+		}
+	}
+
+	for p, content := range old {
+		if _, ok := new[p]; !ok {
+			changes = append(changes, Change{Path: p, Old: content})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
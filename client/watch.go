@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/lib/pq"
+)
+
+// DefaultInterval is the default time between polls for changes
+const DefaultInterval = 30 * time.Second
+
+// WatchOptions configures how a client is kept up to date
+type WatchOptions struct {
+	// Interval between polls, defaults to DefaultInterval. When listening
+	// this is only a fallback in case a notification is missed.
+	Interval time.Duration
+	// Listen is a connection string used to LISTEN for commits so changes
+	// are picked up immediately, only polling is used when empty
+	Listen string
+	// OnError is called with errors from background loads, optional
+	OnError func(error)
+}
+
+// Watch loads the files and then keeps them up to date in the background
+// until the context is cancelled. Only the initial load error is returned.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+
+	_, err := c.Load()
+	if err != nil {
+		return err
+	}
+
+	var notify <-chan *pq.Notification
+	var listener *pq.Listener
+	if len(opts.Listen) > 0 {
+		listener = pq.NewListener(opts.Listen, time.Second, time.Minute, nil)
+		err = listener.Listen(sqlstore.NotifyChannel)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		notify = listener.Notify
+	}
+
+	go func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		if listener != nil {
+			defer listener.Close()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case n := <-notify:
+				// a nil notification means the connection was re-established
+				// and notifications may have been missed
+				if n != nil && !c.affectedBy(n.Extra) {
+					continue
+				}
+			case <-ticker.C:
+			}
+
+			_, err := c.Load()
+			if err != nil && opts.OnError != nil {
+				opts.OnError(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// affectedBy checks if a notification payload is for this repository
+func (c *Client) affectedBy(payload string) bool {
+	var n sqlstore.RefNotification
+	err := json.Unmarshal([]byte(payload), &n)
+	if err != nil {
+		return true
+	}
+	return n.Repository == c.opts.Repository
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/paulhatch/konfigraf/agent"
+)
+
+func agentCommand(connection string, args []string) error {
+	flags := newFlags("agent", "<repo> <dir>")
+	branch := flags.String("branch", "master", "branch, tag or commit to sync")
+	path := flags.String("path", "", "only sync the files below this path")
+	command := flags.String("exec", "", "command to run after every update")
+	interval := flags.Duration("interval", agent.DefaultInterval, "time between checks for changes")
+	listen := flags.Bool("listen", false, "listen for commits instead of relying on polling alone")
+	once := flags.Bool("once", false, "sync once and exit")
+	args = parseArgs(flags, args, 2, 2)
+
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	opts := agent.Options{
+		Repository: args[0],
+		Branch:     *branch,
+		Path:       *path,
+		Dir:        args[1],
+		Command:    *command,
+		Interval:   *interval,
+	}
+	if *listen {
+		opts.Listen = connection
+	}
+
+	a := agent.New(db, opts)
+	if *once {
+		_, err = a.Sync()
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	return a.Run(ctx)
+}
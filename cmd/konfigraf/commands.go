@@ -0,0 +1,766 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/service"
+)
+
+func repoCommand(db *proxy.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("repo requires one of create, list or delete")
+	}
+
+	switch args[0] {
+	case "create":
+		args := parseArgs(newFlags("repo create", "<repo>"), args[1:], 1, 1)
+		_, err := service.CreateRepository(db, args[0])
+		return err
+	case "list":
+		parseArgs(newFlags("repo list", ""), args[1:], 0, 0)
+		repos, err := service.GetRepositories(db)
+		if err != nil {
+			return err
+		}
+		for _, r := range repos {
+			fmt.Println(r.Name)
+		}
+		return nil
+	case "delete":
+		args := parseArgs(newFlags("repo delete", "<repo>"), args[1:], 1, 1)
+		return service.DeleteRepository(db, args[0])
+	default:
+		return fmt.Errorf("unknown repo command %q", args[0])
+	}
+}
+
+func branchCommand(db *proxy.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("branch requires one of create, list, delete, reset or restore")
+	}
+
+	switch args[0] {
+	case "create":
+		flags := newFlags("branch create", "<repo> <branch>")
+		from := flags.String("from", "master", "branch or revision to create the branch from")
+		args := parseArgs(flags, args[1:], 2, 2)
+		return service.CreateBranch(db, args[0], *from, args[1])
+	case "list":
+		args := parseArgs(newFlags("branch list", "<repo>"), args[1:], 1, 1)
+		branches, err := service.GetBranches(db, args[0])
+		if err != nil {
+			return err
+		}
+		for _, b := range branches {
+			fmt.Println(b)
+		}
+		return nil
+	case "delete":
+		flags := newFlags("branch delete", "<repo> <branch>")
+		commit := addSignatureFlags(flags)
+		args := parseArgs(flags, args[1:], 2, 2)
+		return service.DeleteBranch(db, args[0], args[1], *commit.author, *commit.email)
+	case "reset":
+		flags := newFlags("branch reset", "<repo> <branch> <rev>")
+		expect := flags.String("expect", "", "only reset if the branch is still at this commit")
+		args := parseArgs(flags, args[1:], 3, 3)
+		hash, err := service.ResetBranch(db, args[0], args[1], args[2], *expect)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	case "restore":
+		args := parseArgs(newFlags("branch restore", "<repo> <branch> <reflog entry>"), args[1:], 3, 3)
+		entry, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid reflog entry %q", args[2])
+		}
+		hash, err := service.RestoreBranch(db, args[0], args[1], entry)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	default:
+		return fmt.Errorf("unknown branch command %q", args[0])
+	}
+}
+
+func getCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("get", "<repo> <path>")
+	rev := flags.String("rev", "master", "branch, tag or commit to read from")
+	verbose := flags.Bool("v", false, "print the repository and file hashes to stderr")
+	args = parseArgs(flags, args, 2, 2)
+
+	info, err := service.GetFile(db, args[0], *rev, args[1])
+	if err != nil {
+		return err
+	}
+
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "repo %s\nitem %s\n", info.RepoHash, info.ItemHash)
+	}
+
+	_, err = io.WriteString(os.Stdout, info.Contents)
+	return err
+}
+
+func putCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("put", "<repo> <path> [file]")
+	branch := flags.String("branch", "master", "branch to commit to")
+	itemHash := flags.String("item-hash", "", "fail unless the file currently has this hash")
+	repoHash := flags.String("repo-hash", "", "fail unless the branch currently points to this commit")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 2, 3)
+
+	err := commit.validate()
+	if err != nil {
+		return err
+	}
+
+	source := "-"
+	if len(args) == 3 {
+		source = args[2]
+	}
+
+	content, err := readSource(source)
+	if err != nil {
+		return err
+	}
+
+	info, err := service.UpdateFile(db, args[0], args[1], *commit.message, string(content), *commit.author, *commit.email, *itemHash, *repoHash, *branch)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(info.ItemHash, info.RepoHash)
+	return nil
+}
+
+func lsCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("ls", "<repo> [path]")
+	rev := flags.String("rev", "master", "branch, tag or commit to list")
+	args = parseArgs(flags, args, 1, 2)
+
+	path := ""
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	files, err := service.GetFileNames(db, args[0], *rev, path)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		fmt.Println(f)
+	}
+	return nil
+}
+
+func logCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("log", "<repo>")
+	branch := flags.String("branch", "master", "branch or revision to show the log of")
+	since := flags.String("since", "", "only show commits after this date")
+	until := flags.String("until", "", "only show commits before this date")
+	file := flags.String("file", "", "only show commits changing this file")
+	args = parseArgs(flags, args, 1, 1)
+
+	sinceTime, err := parseTime(*since)
+	if err != nil {
+		return err
+	}
+
+	untilTime, err := parseTime(*until)
+	if err != nil {
+		return err
+	}
+
+	entries, err := service.GetHistory(db, args[0], *branch, sinceTime, untilTime, file)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		fmt.Println(e)
+	}
+	return nil
+}
+
+func diffCommand(db *proxy.DB, args []string) error {
+	args = parseArgs(newFlags("diff", "<repo> <path> <from> <to>"), args, 4, 4)
+
+	diff, err := service.DiffFile(db, args[0], args[1], args[2], args[3])
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(os.Stdout, diff)
+	return err
+}
+
+func blameCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("blame", "<repo> <path>")
+	rev := flags.String("rev", "master", "branch, tag or commit to blame")
+	args = parseArgs(flags, args, 2, 2)
+
+	lines, err := service.BlameFile(db, args[0], *rev, args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		fmt.Printf("%s (%s %s %d) %s\n",
+			shortTarget(l.Hash), l.Author, l.Date.Local().Format("2006-01-02 15:04:05"), l.Line, l.Text)
+	}
+	return nil
+}
+
+func valueHistoryCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("value-history", "<repo> <path> <pointer>")
+	branch := flags.String("branch", "master", "branch to read the history of")
+	args = parseArgs(flags, args, 3, 3)
+
+	changes, err := service.ValueHistory(db, args[0], *branch, args[1], args[2])
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		fmt.Printf("%s %s %s: %s -> %s\n",
+			shortTarget(c.Hash), c.Date.Local().Format("2006-01-02 15:04:05"), c.Author, jsonValue(c.Old), jsonValue(c.New))
+	}
+	return nil
+}
+
+// jsonValue formats a value that may be missing
+func jsonValue(v []byte) string {
+	if v == nil {
+		return "(missing)"
+	}
+	return string(v)
+}
+
+func tagCommand(db *proxy.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("tag requires one of create, list or delete")
+	}
+
+	switch args[0] {
+	case "create":
+		flags := newFlags("tag create", "<repo> <tag>")
+		rev := flags.String("rev", "master", "branch, tag or commit to tag")
+		commit := addAuthorFlags(flags)
+		args := parseArgs(flags, args[1:], 2, 2)
+
+		// a message makes this an annotated tag which requires an author
+		if len(*commit.message) > 0 {
+			err := commit.validate()
+			if err != nil {
+				return err
+			}
+		}
+
+		hash, err := service.CreateTag(db, args[0], args[1], *rev, *commit.message, *commit.author, *commit.email)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	case "list":
+		args := parseArgs(newFlags("tag list", "<repo>"), args[1:], 1, 1)
+		tags, err := service.GetTags(db, args[0])
+		if err != nil {
+			return err
+		}
+		for _, t := range tags {
+			fmt.Println(t)
+		}
+		return nil
+	case "delete":
+		args := parseArgs(newFlags("tag delete", "<repo> <tag>"), args[1:], 2, 2)
+		return service.DeleteTag(db, args[0], args[1])
+	default:
+		return fmt.Errorf("unknown tag command %q", args[0])
+	}
+}
+
+func exportCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("export", "<repo> [path]")
+	rev := flags.String("rev", "master", "branch, tag or commit to export")
+	output := flags.String("o", "-", "file to write the archive to")
+	format := flags.String("format", service.ArchiveTar, "archive format, one of tar, tar.gz or zip")
+	matchHash := flags.String("match-hash", "", "write nothing if the revision still resolves to this commit")
+	var include, exclude patterns
+	flags.Var(&include, "include", "only export files matching this glob, may be repeated")
+	flags.Var(&exclude, "exclude", "do not export files matching this glob, may be repeated")
+	args = parseArgs(flags, args, 1, 2)
+
+	path := ""
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	files, err := service.GetArchive(db, args[0], *rev, path, &service.ArchiveOptions{
+		Format:    *format,
+		Include:   include,
+		Exclude:   exclude,
+		MatchHash: *matchHash,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, files.RepoHash)
+	if files.NotModified || files.File == nil {
+		return nil
+	}
+
+	if *output == "-" {
+		_, err = files.File.WriteTo(os.Stdout)
+		return err
+	}
+
+	return ioutil.WriteFile(*output, files.File.Bytes(), 0644)
+}
+
+func importCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("import", "<repo> <tar|dir|->")
+	branch := flags.String("branch", "master", "branch to commit to")
+	prefix := flags.String("prefix", "", "path to import the files below")
+	sync := flags.Bool("sync", false, "delete files below the prefix that are not imported")
+	repoHash := flags.String("repo-hash", "", "fail unless the branch currently points to this commit")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 2, 2)
+
+	err := commit.validate()
+	if err != nil {
+		return err
+	}
+
+	mode := service.ImportOverlay
+	if *sync {
+		mode = service.ImportSync
+	}
+
+	var info *service.FileInfo
+	if stat, err := os.Stat(args[1]); err == nil && stat.IsDir() {
+		files, err := readDirectory(args[1])
+		if err != nil {
+			return err
+		}
+		info, err = service.ImportFiles(db, args[0], *branch, *prefix, files, *commit.message, *commit.author, *commit.email, mode, *repoHash)
+		if err != nil {
+			return err
+		}
+	} else {
+		var r io.Reader = os.Stdin
+		if args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		info, err = service.ImportTar(db, args[0], *branch, *prefix, r, *commit.message, *commit.author, *commit.email, mode, *repoHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(info.RepoHash)
+	return nil
+}
+
+func bundleCommand(db *proxy.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("bundle requires one of export or import")
+	}
+
+	switch args[0] {
+	case "export":
+		flags := newFlags("bundle export", "<repo> [ref...]")
+		since := flags.String("since", "", "only include objects added after this commit")
+		output := flags.String("o", "-", "file to write the bundle to")
+		args := parseArgs(flags, args[1:], 1, -1)
+
+		bundle, err := service.ExportBundle(db, args[0], args[1:], *since)
+		if err != nil {
+			return err
+		}
+
+		if *output == "-" {
+			_, err = os.Stdout.Write(bundle)
+			return err
+		}
+		return ioutil.WriteFile(*output, bundle, 0644)
+	case "import":
+		args := parseArgs(newFlags("bundle import", "<repo> <file|->"), args[1:], 2, 2)
+
+		var r io.Reader = os.Stdin
+		if args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		updated, err := service.ImportBundle(db, args[0], r)
+		if err != nil {
+			return err
+		}
+		for _, ref := range updated {
+			fmt.Println(ref)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown bundle command %q", args[0])
+	}
+}
+
+func revertCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("revert", "<repo> <commit>")
+	branch := flags.String("branch", "master", "branch to commit the revert to")
+	commit := addSignatureFlags(flags)
+	args = parseArgs(flags, args, 2, 2)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.RevertCommit(db, args[0], *branch, args[1], *commit.author, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func cherryPickCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("cherry-pick", "<repo> <commit> <branch>")
+	commit := addSignatureFlags(flags)
+	args = parseArgs(flags, args, 3, 3)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.CherryPick(db, args[0], args[1], args[2], *commit.author, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func mvCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("mv", "<repo> <from> <to>")
+	branch := flags.String("branch", "master", "branch to commit the move to")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 3, 3)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.MovePath(db, args[0], *branch, args[1], args[2], *commit.author, *commit.message, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func cpCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("cp", "<repo> <path> <to repo> <to path>")
+	rev := flags.String("rev", "master", "branch, tag or commit to copy from")
+	branch := flags.String("branch", "master", "branch to commit the copy to")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 4, 4)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.CopyPath(db, args[0], *rev, args[1], args[2], *branch, args[3], *commit.author, *commit.message, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func restoreCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("restore", "<repo> <path> <rev>")
+	branch := flags.String("branch", "master", "branch to commit the restored files to")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 3, 3)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.RestorePath(db, args[0], *branch, args[1], args[2], *commit.author, *commit.message, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func promoteCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("promote", "<repo> <path> <from branch> <to branch>")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 4, 4)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	summary, err := service.PromotePath(db, args[0], args[2], args[3], args[1], *commit.author, *commit.message, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range summary.Added {
+		fmt.Printf("A\t%s\n", p)
+	}
+	for _, p := range summary.Modified {
+		fmt.Printf("M\t%s\n", p)
+	}
+	for _, p := range summary.Deleted {
+		fmt.Printf("D\t%s\n", p)
+	}
+	fmt.Println(summary.Commit)
+	return nil
+}
+
+func rebaseCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("rebase", "<repo> <branch> <onto>")
+	commit := addSignatureFlags(flags)
+	args = parseArgs(flags, args, 3, 3)
+
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.RebaseBranch(db, args[0], args[1], args[2], *commit.author, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func squashCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("squash", "<repo> <branch> <since>")
+	commit := addAuthorFlags(flags)
+	args = parseArgs(flags, args, 3, 3)
+
+	// an empty message combines the squashed messages
+	err := commit.validateAuthor()
+	if err != nil {
+		return err
+	}
+
+	hash, err := service.SquashBranch(db, args[0], args[1], args[2], *commit.message, *commit.author, *commit.email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hash)
+	return nil
+}
+
+func reflogCommand(db *proxy.DB, args []string) error {
+	args = parseArgs(newFlags("reflog", "<repo> <ref>"), args, 2, 2)
+
+	entries, err := service.GetReflog(db, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%d\t%s\t%s\t%s -> %s\t%s\t%s\n",
+			e.ID, e.Created.Local().Format(time.RFC3339), e.Operation,
+			shortTarget(e.Old), shortTarget(e.New), e.Who, e.Message)
+	}
+	return nil
+}
+
+// shortTarget abbreviates a hash the way git does, missing targets are shown
+// as a dash
+func shortTarget(target string) string {
+	if len(target) == 0 {
+		return "-"
+	}
+	if len(target) == 40 {
+		return target[:7]
+	}
+	return target
+}
+
+func gcCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("gc", "<repo>")
+	grace := flags.String("grace", "1 day", "keep unreachable objects newer than this Postgres interval")
+	reflogExpiry := flags.String("reflog-expiry", service.DefaultReflogExpiry, "delete reflog entries older than this Postgres interval")
+	args = parseArgs(flags, args, 1, 1)
+
+	result, err := service.CollectGarbage(db, args[0], *grace, *reflogExpiry)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("expired %d reflog entries, deleted %d objects (%d bytes), %d reachable, %d unreachable within the grace period\n",
+		result.Expired, result.Deleted, result.Bytes, result.Reachable, result.Pending)
+	return nil
+}
+
+func purgeCommand(db *proxy.DB, args []string) error {
+	args = parseArgs(newFlags("purge", "<repo> <path>"), args, 2, 2)
+
+	result, err := service.PurgePath(db, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range result.Refs {
+		fmt.Println(ref)
+	}
+	fmt.Printf("rewrote %d commits, deleted %d objects (%d bytes)\n",
+		result.Commits, result.Deleted, result.Bytes)
+	return nil
+}
+
+func retentionCommand(db *proxy.DB, args []string) error {
+	flags := newFlags("retention", "<repo>")
+	keepFor := flags.String("keep-for", "", "keep commits newer than this Postgres interval")
+	keepCommits := flags.Int64("keep-commits", 0, "keep this many of the latest commits of each branch")
+	args = parseArgs(flags, args, 1, 1)
+
+	return service.SetRetention(db, args[0], *keepFor, *keepCommits)
+}
+
+func pruneHistoryCommand(db *proxy.DB, args []string) error {
+	args = parseArgs(newFlags("prune-history", "<repo>"), args, 1, 1)
+
+	result, err := service.PruneHistory(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("kept %d commits (%d shallow), removed %d reflog entries, deleted %d objects (%d bytes), %d unreachable within the grace period\n",
+		result.Retained, result.Shallow, result.Reflog, result.Deleted, result.Bytes, result.Pending)
+	return nil
+}
+
+func repackCommand(db *proxy.DB, args []string) error {
+	args = parseArgs(newFlags("repack", "<repo>"), args, 1, 1)
+
+	result, err := service.Repack(db, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rewrote %d objects (%d as deltas), %d bytes before, %d bytes after\n",
+		result.Objects, result.Deltas, result.BytesBefore, result.BytesAfter)
+	return nil
+}
+
+// patterns collects a flag that may be given more than once
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// readSource reads a file, or stdin when the name is -
+func readSource(name string) ([]byte, error) {
+	if name == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// readDirectory reads all regular files below the directory, hidden files
+// and directories such as .git are skipped
+func readDirectory(root string) ([]service.FileUpdate, error) {
+	var updates []service.FileUpdate
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != root && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		updates = append(updates, service.FileUpdate{Path: filepath.ToSlash(rel), Content: content})
+		return nil
+	})
+
+	return updates, err
+}
+
+// parseTime parses an optional RFC 3339 timestamp or plain date
+func parseTime(value string) (*time.Time, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", value)
+}
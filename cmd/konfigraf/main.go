@@ -0,0 +1,226 @@
+// Command konfigraf is a command line client for working with Konfigraf
+// repositories without writing SQL.
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	_ "github.com/lib/pq"
+)
+
+const usage = `Usage: konfigraf [-d connection] <command> [arguments]
+
+Commands:
+  repo create <repo>               create a repository
+  repo list                        list repositories
+  repo delete <repo>               delete a repository
+  branch list <repo>               list branches
+  branch create <repo> <branch>    create a branch
+  branch delete <repo> <branch>    delete a branch
+  branch reset <repo> <branch> <rev>
+                                   move a branch to a commit, tag or revision
+  branch restore <repo> <branch> <entry>
+                                   move a branch back to a reflog entry
+  get <repo> <path>                print a file
+  put <repo> <path> [file]         commit a file from disk or stdin
+  ls <repo> [path]                 list files, end path with * to recurse
+  log <repo>                       show the commit log
+  diff <repo> <path> <from> <to>   show the diff of a file between revisions
+  blame <repo> <path>              show who last changed each line of a file
+  value-history <repo> <path> <pointer>
+                                   show the changes to a value of a JSON file
+  revert <repo> <commit>           commit the inverse of a commit
+  cherry-pick <repo> <commit> <branch>
+                                   apply the changes of a commit to a branch
+  mv <repo> <from> <to>            move or rename a file or directory
+  cp <repo> <path> <to repo> <to path>
+                                   copy a file or directory between repositories
+  restore <repo> <path> <rev>      commit a file or directory as it was at rev
+  promote <repo> <path> <from> <to>
+                                   make a path of a branch match another branch
+  rebase <repo> <branch> <onto>    replay the commits of a branch onto another
+  squash <repo> <branch> <since>   collapse the commits after since into one
+  reflog <repo> <ref>              show where a branch or tag has pointed
+  tag list <repo>                  list tags
+  tag create <repo> <tag>          tag a revision
+  tag delete <repo> <tag>          delete a tag
+  export <repo> [path]             write files as a tar, tar.gz or zip archive
+  import <repo> <tar|dir>          commit a tar archive or directory
+  bundle export <repo> [ref...]    write branches and tags as a git bundle
+  bundle import <repo> <file>      fetch branches and tags from a git bundle
+  gc <repo>                        delete objects no longer reachable
+  purge <repo> <path>              remove a path from all history
+  retention <repo>                 set how much history prune-history keeps
+  prune-history <repo>             remove history older than the retention
+  repack <repo>                    store file versions as deltas
+  agent <repo> <dir>               keep a local directory in sync with a branch
+
+The connection string is read from KONFIGRAF_DATABASE_URL when -d is not
+given. Run "konfigraf <command> -h" for the options of a command.
+`
+
+// command runs a subcommand against the database
+type command func(db *proxy.DB, args []string) error
+
+var commands = map[string]command{
+	"repo":          repoCommand,
+	"branch":        branchCommand,
+	"get":           getCommand,
+	"put":           putCommand,
+	"ls":            lsCommand,
+	"log":           logCommand,
+	"diff":          diffCommand,
+	"blame":         blameCommand,
+	"value-history": valueHistoryCommand,
+	"revert":        revertCommand,
+	"cherry-pick":   cherryPickCommand,
+	"mv":            mvCommand,
+	"cp":            cpCommand,
+	"restore":       restoreCommand,
+	"promote":       promoteCommand,
+	"rebase":        rebaseCommand,
+	"squash":        squashCommand,
+	"reflog":        reflogCommand,
+	"tag":           tagCommand,
+	"export":        exportCommand,
+	"import":        importCommand,
+	"bundle":        bundleCommand,
+	"gc":            gcCommand,
+	"purge":         purgeCommand,
+	"retention":     retentionCommand,
+	"prune-history": pruneHistoryCommand,
+	"repack":        repackCommand,
+}
+
+func main() {
+	flags := flag.NewFlagSet("konfigraf", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	connection := flags.String("d", os.Getenv("KONFIGRAF_DATABASE_URL"), "database connection string")
+	flags.Parse(os.Args[1:])
+
+	args := flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok && args[0] != "agent" {
+		fmt.Fprintf(os.Stderr, "konfigraf: unknown command %q\n\n", args[0])
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if len(*connection) == 0 {
+		fail(fmt.Errorf("no database connection string, use -d or set KONFIGRAF_DATABASE_URL"))
+	}
+
+	var err error
+	if args[0] == "agent" {
+		// the agent is long running so it does not use a single transaction
+		err = agentCommand(*connection, args[1:])
+	} else {
+		err = run(*connection, cmd, args[1:])
+	}
+
+	if err != nil {
+		fail(err)
+	}
+}
+
+// run executes the command within a single transaction so that a failed
+// command never leaves partially written objects or references behind
+func run(connection string, cmd command, args []string) error {
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = cmd(proxy.NewSQL(tx), args)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "konfigraf: %s\n", err)
+	os.Exit(1)
+}
+
+// newFlags creates the flag set for a subcommand
+func newFlags(name string, args string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: konfigraf %s [options] %s\n", name, args)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseArgs parses the flags of a subcommand and checks the number of
+// positional arguments is between min and max, a negative max is unlimited
+func parseArgs(flags *flag.FlagSet, args []string, min int, max int) []string {
+	flags.Parse(args)
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		flags.Usage()
+		os.Exit(2)
+	}
+	return flags.Args()
+}
+
+// authorFlags adds the flags used to describe a commit
+type authorFlags struct {
+	author  *string
+	email   *string
+	message *string
+}
+
+func addAuthorFlags(flags *flag.FlagSet) *authorFlags {
+	a := addSignatureFlags(flags)
+	a.message = flags.String("m", "", "commit message")
+	return a
+}
+
+// addSignatureFlags adds the author flags without -m, for commands that
+// write their own commit message
+func addSignatureFlags(flags *flag.FlagSet) *authorFlags {
+	empty := ""
+	return &authorFlags{
+		author:  flags.String("author", os.Getenv("KONFIGRAF_AUTHOR"), "commit author, defaults to KONFIGRAF_AUTHOR"),
+		email:   flags.String("email", os.Getenv("KONFIGRAF_EMAIL"), "commit author email, defaults to KONFIGRAF_EMAIL"),
+		message: &empty,
+	}
+}
+
+func (a *authorFlags) validate() error {
+	if err := a.validateAuthor(); err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(*a.message)) == 0 {
+		return fmt.Errorf("a commit message is required, use -m")
+	}
+	return nil
+}
+
+// validateAuthor checks the author for commands with a default message
+func (a *authorFlags) validateAuthor() error {
+	if len(strings.TrimSpace(*a.author)) == 0 {
+		return fmt.Errorf("an author is required, use -author or set KONFIGRAF_AUTHOR")
+	}
+	return nil
+}
@@ -4,12 +4,25 @@ create table if not exists repository
   id         serial      not null
     constraint repository_pkey
       primary key,
-  name       varchar(50) not null,
-  remote_url text
+  name           varchar(50) not null,
+  remote_url     text,
+  retain_for     interval,
+  retain_commits integer,
+  generation     bigint      not null default 0
 );
 create unique index if not exists repository_name_uindex
   on repository (name);
 
+-- history retention enforced by prune_history, commits newer than retain_for
+-- or among the latest retain_commits of a branch are kept and null means no
+-- limit
+alter table repository add column if not exists retain_for interval;
+alter table repository add column if not exists retain_commits integer;
+
+-- counts the times objects have been deleted from a repository, so that every
+-- backend drops the objects it has cached once it sees a new generation
+alter table repository add column if not exists generation bigint not null default 0;
+
 create table if not exists objects
 (
   repo_id  integer  not null
@@ -17,12 +30,49 @@ create table if not exists objects
       references repository
       on delete cascade,
   obj_type integer  not null,
-  hash     char(40) not null,
+  hash     bytea    not null,
   blob     bytea    not null,
+  created  timestamptz not null default now(),
+  format   smallint not null default 0,
+  base     bytea,
+  size     bigint,
   constraint objects_pk
-    primary key (repo_id, obj_type, hash)
+    primary key (repo_id, hash)
 );
 
+-- added for garbage collection, objects written before it count as new
+alter table objects add column if not exists created timestamptz not null default now();
+
+-- objects written before compression was added keep the raw format 0, 1 is
+-- zlib compressed and 2 is a compressed delta against the base object
+alter table objects add column if not exists format smallint not null default 0;
+alter table objects add column if not exists base bytea;
+
+-- the decoded size lets objects be listed without reading their content, it
+-- is null for compressed objects written before it was added and those are
+-- sized when read
+alter table objects add column if not exists size bigint;
+update objects set size = octet_length(blob) where size is null and format = 0;
+
+-- hashes were stored as 40 character hex strings with the type in the primary
+-- key, convert them to 20 bytes keyed by hash alone so lookups of any type
+-- use the index
+do
+$$
+  begin
+    if (select format_type(atttypid, atttypmod) from pg_attribute
+        where attrelid = 'objects'::regclass and attname = 'hash') <> 'bytea' then
+      alter table objects drop constraint objects_pk;
+      alter table objects alter column hash type bytea using decode(hash, 'hex');
+      alter table objects add constraint objects_pk primary key (repo_id, hash);
+    end if;
+    if (select format_type(atttypid, atttypmod) from pg_attribute
+        where attrelid = 'objects'::regclass and attname = 'base') <> 'bytea' then
+      alter table objects alter column base type bytea using decode(base, 'hex');
+    end if;
+  end
+$$;
+
 create table if not exists refs
 (
   repo_id integer not null
@@ -35,6 +85,28 @@ create table if not exists refs
     primary key (repo_id, name)
 );
 
+-- every movement of a reference, a null old target means the reference was
+-- created and a null new target that it was removed
+create table if not exists reflog
+(
+  id         bigserial   not null
+    constraint reflog_pk
+      primary key,
+  repo_id    integer     not null
+    constraint config_reflog_id_fk
+      references repository
+      on delete cascade,
+  name       text        not null,
+  old_target text,
+  new_target text,
+  who        text        not null,
+  operation  text        not null,
+  message    text        not null default '',
+  created    timestamptz not null default now()
+);
+create index if not exists reflog_name_index
+  on reflog (repo_id, name);
+
 create table if not exists config
 (
   repo_id integer not null
@@ -66,4 +138,110 @@ create table if not exists index
       references repository
       on delete cascade,
   data    json    not null
-);
\ No newline at end of file
+);
+-- Imports without checking the branch head, the same as passing an empty
+-- expected hash
+create or replace function import_tar(repo text, branch text, prefix text, data bytea,
+                                      author text, message text, email text, mode text)
+  returns text
+  language sql
+as
+$$
+  select import_tar(repo, branch, prefix, data, author, message, email, mode, '');
+$$;
+
+-- Resolves the revision once so the archive and the returned hash always refer
+-- to the same commit, even if the branch moves while the archive is built.
+create or replace function export_archive(repo text, rev text, path text, format text,
+                                          include text[] default '{}', exclude text[] default '{}',
+                                          out repo_hash text, out data bytea)
+  language sql
+as
+$$
+  select r.hash, get_archive(repo, r.hash, path, format, include, exclude)
+  from (select resolve_revision(repo, rev) as hash) r;
+$$;
+
+-- Deletes objects that cannot be reached from any reference and are older
+-- than the grace period, after waiting for transactions writing objects to
+-- the repository to end. Objects written but not yet referenced by a later
+-- transaction are protected by the grace period. Reflog entries older than
+-- reflog_expiry are deleted first so their commits can be collected.
+drop function if exists gc_repository(text, interval);
+create or replace function gc_repository(repo text, grace interval default interval '1 day',
+                                         reflog_expiry interval default interval '90 days')
+  returns json
+  language sql
+as
+$$
+  select collect_garbage(repo, grace::text, reflog_expiry::text)::json;
+$$;
+
+-- Sets how much history prune_history keeps, commits are kept while they are
+-- either newer than keep_for or among the latest keep_commits of a branch.
+-- Passing null for both removes the policy.
+create or replace function set_history_retention(repo text, keep_for interval default null,
+                                                 keep_commits integer default null)
+  returns void
+  language sql
+as
+$$
+  select set_retention(repo, coalesce(keep_for::text, ''), coalesce(keep_commits, 0));
+$$;
+
+-- One row per line of a file with the commit that last changed the line
+create or replace function blame_file(repo text, rev text, path text)
+  returns table
+          (
+            line_number integer,
+            commit_hash text,
+            author      text,
+            email       text,
+            date        timestamptz,
+            line        text
+          )
+  language sql
+as
+$$
+  select b.line, b.hash, b.author, b.email, b.date, b.text
+  from json_to_recordset(get_blame(repo, rev, path)::json)
+         as b(line integer, hash text, author text, email text, date timestamptz, text text);
+$$;
+
+-- One row per commit that changed the value at a JSON path or pointer of a
+-- JSON file, newest first
+create or replace function value_history(repo text, branch text, path text, pointer text)
+  returns table
+          (
+            commit_hash text,
+            author      text,
+            email       text,
+            date        timestamptz,
+            message     text,
+            old_value   jsonb,
+            new_value   jsonb
+          )
+  language sql
+as
+$$
+  select v.hash, v.author, v.email, v.date, v.message, v.old, v.new
+  from json_to_recordset(get_value_history(repo, branch, path, pointer)::json)
+         as v(hash text, author text, email text, date timestamptz, message text, old jsonb, new jsonb);
+$$;
+
+-- Rebases and squashes as the current database user when no author is given
+create or replace function rebase_branch(repo text, branch text, onto text)
+  returns text
+  language sql
+as
+$$
+  select rebase_branch(repo, branch, onto, session_user::text, '');
+$$;
+
+create or replace function squash_branch(repo text, branch text, since_rev text, message text)
+  returns text
+  language sql
+as
+$$
+  select squash_branch(repo, branch, since_rev, message, session_user::text, '');
+$$;
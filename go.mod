@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/go-git/go-billy/v5 v5.2.0
 	github.com/go-git/go-git/v5 v5.3.0
+	github.com/lib/pq v1.10.9
 	github.com/paulhatch/plgo v1.4.0
 )
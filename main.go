@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"log"
 	"time"
 
@@ -86,7 +88,7 @@ func DeleteBranch(repoName string, branch string) {
 	defer db.Close()
 	database := newProxy(db)
 
-	err = service.DeleteBranch(database, repoName, branch)
+	err = service.DeleteBranch(database, repoName, branch, "", "")
 	if err != nil {
 		logger.Fatalf("Error: %s", err)
 	}
@@ -128,6 +130,32 @@ func commitFileImpl(repoName string, path string, content string, author string,
 	return []string{info.ItemHash, info.RepoHash}
 }
 
+// Imports the files of a tar archive below a path as a single commit, mode is
+// either overlay to keep other files or sync to delete files not in the archive.
+// When the expected hash is not empty the import fails unless the branch still
+// points to that commit.
+func ImportTar(repoName string, branch string, prefix string, data []byte, author string, message string, email string, mode string, expectedHash string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, mode, "Mode")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	info, err := service.ImportTar(database, repoName, branch, prefix, bytes.NewReader(data), message, author, email, mode, expectedHash)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return info.RepoHash
+}
+
 // Gets a file from a repository at the specified path of the master branch.
 func GetFile(repoName string, path string) string {
 	return getFileImpl(repoName, path, "master")
@@ -213,7 +241,7 @@ func getHistoryImpl(repoName string, branch string, since *time.Time, until *tim
 	defer db.Close()
 	database := newProxy(db)
 
-	history, err := service.GetHistory(database, repoName, branch, since, until, nil)
+	history, err := service.GetHistory(database, repoName, branch, since, until, &file)
 
 	if err != nil {
 		logger.Fatalf("Error: %s", err)
@@ -265,6 +293,596 @@ func GetDiff(repoName, file, fromBranch, toBranch string) string {
 	return diff
 }
 
+// Returns every line of a file at a revision with the commit, author, email
+// and date that last changed it as JSON. Use blame_file for one row per line.
+func GetBlame(repoName string, rev string, path string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, rev, "Revision")
+	require(logger, path, "Path")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	lines, err := service.BlameFile(database, repoName, rev, path)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(lines)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Lists the commits of a branch that changed the value at a JSON path or
+// JSON pointer of a JSON file with the old and new values as JSON, newest
+// first. Use value_history for one row per change.
+func GetValueHistory(repoName string, branch string, path string, pointer string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch")
+	require(logger, path, "Path")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	changes, err := service.ValueHistory(database, repoName, branch, path, pointer)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(changes)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Gets the files below a path of a revision as an archive, format is one of
+// tar, tar.gz or zip and the include and exclude glob patterns filter the files
+func GetArchive(repoName string, rev string, path string, format string, include []string, exclude []string) []byte {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, rev, "Revision")
+	require(logger, format, "Format")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	files, err := service.GetArchive(database, repoName, rev, path, &service.ArchiveOptions{
+		Format:  format,
+		Include: include,
+		Exclude: exclude,
+	})
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	if files.File == nil {
+		return []byte{}
+	}
+	return files.File.Bytes()
+}
+
+// Resolves a branch, tag or revision expression to a commit hash
+func ResolveRevision(repoName string, rev string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, rev, "Revision")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.ResolveRevision(database, repoName, rev)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Exports branches and tags as a git bundle, all of them when refs is empty.
+// When since_commit is given the bundle only holds objects added after it.
+func ExportBundle(repoName string, refs []string, sinceCommit string) []byte {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	bundle, err := service.ExportBundle(database, repoName, refs, sinceCommit)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return bundle
+}
+
+// Imports a git bundle into an existing repository, references are only
+// fast forwarded. Returns the names of the references that were updated.
+func ImportBundle(repoName string, data []byte) []string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	updated, err := service.ImportBundle(database, repoName, bytes.NewReader(data))
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return updated
+}
+
+// Deletes objects no longer reachable from any branch, tag or reflog entry
+// that are older than the grace interval, returns the counts and bytes
+// reclaimed as JSON. Reflog entries older than the reflog expiry interval are
+// deleted first, an empty expiry keeps them for 90 days. Use gc_repository to
+// pass the grace period and expiry as intervals.
+func CollectGarbage(repoName string, grace string, reflogExpiry string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, grace, "Grace period")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	result, err := service.CollectGarbage(database, repoName, grace, reflogExpiry)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Removes a file or directory from every commit of every branch and tag,
+// moves the references and reflog to the rewritten history and deletes the
+// objects that are no longer reachable regardless of their age. Returns the
+// number of commits rewritten, the references moved and the objects deleted
+// as JSON.
+func PurgePath(repoName string, path string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, path, "Path")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	result, err := service.PurgePath(database, repoName, path)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Sets how much history prune_history keeps, keep for is a Postgres interval
+// such as 2 years and keep commits a number of commits per branch. An empty
+// interval or zero commits means no limit. Use set_history_retention to pass
+// the period as an interval.
+func SetRetention(repoName string, keepFor string, keepCommits int64) {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	err = service.SetRetention(database, repoName, keepFor, keepCommits)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+}
+
+// Removes the history older than the retention policy of the repository, the
+// oldest kept commits become shallow and the objects only older history used
+// are deleted. Returns the counts as JSON.
+func PruneHistory(repoName string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	result, err := service.PruneHistory(database, repoName)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Stores the versions of each file as deltas against the next newer version
+// and compresses objects written by older versions, returns the number of
+// objects rewritten and the storage used before and after as JSON.
+func RepackRepository(repoName string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	result, err := service.Repack(database, repoName)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Commits the inverse of the changes made by a commit on top of a branch and
+// returns the new commit hash. Fails with a conflict if a later commit changed
+// the same files.
+func RevertCommit(repoName string, branch string, commit string, author string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, commit, "Commit")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.RevertCommit(database, repoName, branch, commit, author, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Applies the changes of a single commit onto another branch keeping the
+// original author, the message notes the commit it was picked from. Fails
+// with a conflict listing the paths the branch has changed differently.
+// Returns the new commit hash.
+func CherryPick(repoName string, commit string, ontoBranch string, author string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, commit, "Commit")
+	require(logger, ontoBranch, "Branch name")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.CherryPick(database, repoName, commit, ontoBranch, author, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Commits a file or directory of a branch as it was at an earlier revision,
+// files that did not exist then are deleted. An empty path restores the whole
+// tree and an empty message uses a default. Returns the new commit hash.
+func RestorePath(repoName string, branch string, path string, fromRev string, author string, message string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, fromRev, "Revision")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.RestorePath(database, repoName, branch, path, fromRev, author, message, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Moves a file or directory of a branch to a new path in one commit, the log
+// and diffs follow the move as a rename. An empty message uses a default.
+// Returns the new commit hash.
+func MovePath(repoName string, branch string, from string, to string, author string, message string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, from, "Path")
+	require(logger, to, "New path")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.MovePath(database, repoName, branch, from, to, author, message, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Copies a file or directory at a revision of one repository to a path of a
+// branch in another in one commit, reusing the stored objects. The message
+// ends with a trailer naming the source repository, commit and path and an
+// empty message uses a default. Returns the new commit hash.
+func CopyPath(srcRepo string, srcRev string, srcPath string, dstRepo string, dstBranch string, dstPath string, author string, message string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, srcRepo, "Source repository name")
+	require(logger, srcRev, "Source revision")
+	require(logger, dstRepo, "Destination repository name")
+	require(logger, dstBranch, "Destination branch name")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.CopyPath(database, srcRepo, srcRev, srcPath, dstRepo, dstBranch, dstPath, author, message, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Makes a file or directory of a branch identical to the same path of another
+// branch in one commit, including deletions. An empty path promotes the whole
+// tree and an empty message uses a default. Returns the new commit and the
+// files added, modified and deleted as JSON.
+func PromotePath(repoName string, fromBranch string, toBranch string, path string, author string, message string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, fromBranch, "Source branch")
+	require(logger, toBranch, "Target branch")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	summary, err := service.PromotePath(database, repoName, fromBranch, toBranch, path, author, message, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Replays the commits of a branch that are not on another branch or revision
+// on top of it and moves the branch in one step. The previous head is kept in
+// the reflog. The author is the committer of the replayed commits. Returns the
+// new head of the branch.
+func RebaseBranch(repoName string, branch string, onto string, author string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, onto, "Revision")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.RebaseBranch(database, repoName, branch, onto, author, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Replaces the commits of a branch after a revision with a single commit, an
+// empty message combines the messages of the squashed commits and the author
+// is the committer. The previous head is kept in the reflog. Returns the new
+// head of the branch.
+func SquashBranch(repoName string, branch string, sinceRev string, message string, author string, email string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, sinceRev, "Revision")
+	require(logger, author, "Author")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.SquashBranch(database, repoName, branch, sinceRev, message, author, email)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Lists the recorded movements of a branch or tag as JSON, newest first
+func GetReflog(repoName string, ref string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, ref, "Reference")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	entries, err := service.GetReflog(database, repoName, ref)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return string(data)
+}
+
+// Moves a branch to any commit, tag or revision expression. When the expected
+// hash is not empty the branch is only moved if its head is still that
+// commit. Returns the new head of the branch.
+func ResetBranch(repoName string, branch string, rev string, expectedHash string) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+	require(logger, rev, "Revision")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.ResetBranch(database, repoName, branch, rev, expectedHash)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
+// Moves a branch back to where it pointed after a reflog entry, recreating it
+// if it was deleted, and returns the restored commit hash
+func RestoreBranch(repoName string, branch string, reflogEntry int64) string {
+	logger := plgo.NewNoticeLogger("konfigraf: ", log.Ltime)
+	require(logger, repoName, "Repository name")
+	require(logger, branch, "Branch name")
+
+	db, err := plgo.Open()
+	if err != nil {
+		logger.Fatalf("Cannot open DB: %s", err)
+	}
+	defer db.Close()
+	database := newProxy(db)
+
+	hash, err := service.RestoreBranch(database, repoName, branch, reflogEntry)
+
+	if err != nil {
+		logger.Fatalf("Error: %s", err)
+	}
+
+	return hash
+}
+
 // Validation method for strings
 func require(l *log.Logger, v string, n string) {
 	if len(v) == 0 {
@@ -303,7 +921,7 @@ func newProxy(db *plgo.DB) *proxy.DB {
 			return rows.Scan(args...)
 		}
 
-		return &proxy.Rows{next, scan}, nil
+		return &proxy.Rows{NextFunc: next, ScanFunc: scan}, nil
 	}
 
 	queryRow := func(query string, types []string, args []interface{}) (*proxy.Row, error) {
@@ -321,8 +939,8 @@ func newProxy(db *plgo.DB) *proxy.DB {
 			return row.Scan(args...)
 		}
 
-		return &proxy.Row{scan}, nil
+		return &proxy.Row{ScanFunc: scan}, nil
 	}
 
-	return &proxy.DB{exec, query, queryRow}
+	return &proxy.DB{ExecFunc: exec, QueryFunc: query, QueryRowFunc: queryRow}
 }
@@ -23,6 +23,9 @@ func (db *DB) QueryRow(query string, types []string, args ...interface{}) (*Row,
 type Rows struct {
 	NextFunc func() bool
 	ScanFunc func(args []interface{}) error
+	// CloseFunc is optional, it is only required where the rows hold on to a
+	// connection until they are released
+	CloseFunc func() error
 }
 
 func (rows *Rows) Next() bool {
@@ -33,6 +36,14 @@ func (rows *Rows) Scan(args ...interface{}) error {
 	return rows.ScanFunc(args)
 }
 
+// Close releases the rows before they have been fully read
+func (rows *Rows) Close() error {
+	if rows.CloseFunc == nil {
+		return nil
+	}
+	return rows.CloseFunc()
+}
+
 // Row from a query
 type Row struct {
 	ScanFunc func(args []interface{}) error
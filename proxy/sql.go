@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// Queryer is the part of the database/sql API used by the proxy, it is
+// implemented by both *sql.DB and *sql.Tx
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// NewSQL creates a proxy API to access the database with from a database/sql
+// connection or transaction, allowing the service to be used outside of the
+// extension. The parameter types are only needed by the extension to prepare
+// statements and are ignored here, slices are sent and scanned as arrays.
+func NewSQL(q Queryer) *DB {
+
+	exec := func(query string, types []string, args []interface{}) error {
+		_, err := q.Exec(query, arrays(args)...)
+		return err
+	}
+
+	query := func(query string, types []string, args []interface{}) (*Rows, error) {
+		rows, err := q.Query(query, arrays(args)...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Rows{
+			NextFunc: rows.Next,
+			ScanFunc: func(args []interface{}) error {
+				return rows.Scan(arrays(args)...)
+			},
+			CloseFunc: rows.Close,
+		}, nil
+	}
+
+	queryRow := func(query string, types []string, args []interface{}) (*Row, error) {
+		row := q.QueryRow(query, arrays(args)...)
+
+		return &Row{
+			ScanFunc: func(args []interface{}) error {
+				return row.Scan(arrays(args)...)
+			},
+		}, nil
+	}
+
+	return &DB{
+		ExecFunc:     exec,
+		QueryFunc:    query,
+		QueryRowFunc: queryRow,
+	}
+}
+
+// arrays wraps slices so database/sql sends and scans them as Postgres arrays,
+// the extension handles them natively
+func arrays(args []interface{}) []interface{} {
+	wrapped := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch arg.(type) {
+		case []string, []int, []int32, []int64, *[]string, *[]int, *[]int32, *[]int64:
+			wrapped[i] = pq.Array(arg)
+		default:
+			wrapped[i] = arg
+		}
+	}
+	return wrapped
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+const (
+	// ArchiveTar is an uncompressed tar archive
+	ArchiveTar = "tar"
+	// ArchiveTarGz is a gzip compressed tar archive
+	ArchiveTarGz = "tar.gz"
+	// ArchiveZip is a zip archive
+	ArchiveZip = "zip"
+)
+
+// ArchiveOptions controls the format and content of an archive
+type ArchiveOptions struct {
+	// Format of the archive, one of ArchiveTar, ArchiveTarGz or ArchiveZip
+	Format string
+	// Include only files matching at least one of these patterns, all files
+	// are included when empty
+	Include []string
+	// Exclude files matching any of these patterns
+	Exclude []string
+	// MatchHash skips building the archive if the revision still resolves to
+	// this commit hash
+	MatchHash string
+}
+
+// archiveFile is a file to be written to an archive
+type archiveFile struct {
+	name     string
+	mode     int64
+	modified time.Time
+	contents []byte
+}
+
+// GetArchive retrieves the files below a path as an archive. Files have the
+// time of the last commit that changed them as their modification time.
+func GetArchive(
+	db *proxy.DB,
+	name string,
+	rev string,
+	path string,
+	opts *ArchiveOptions) (*FilesTar, error) {
+
+	write, ok := archiveWriters[opts.Format]
+	if !ok {
+		return nil, &Error{fmt.Sprintf("invalid archive format %q, expected %s, %s or %s", opts.Format, ArchiveTar, ArchiveTarGz, ArchiveZip), InvalidArgument}
+	}
+
+	for _, pattern := range append(opts.Include, opts.Exclude...) {
+		if _, err := matchPattern(pattern, ""); err != nil {
+			return nil, &Error{fmt.Sprintf("invalid pattern %q", pattern), InvalidArgument}
+		}
+	}
+
+	rootPath := strings.Trim(strings.TrimSuffix(path, "*"), "/")
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, rh, err := resolveTreeFromName(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	repoHash := rh.String()
+
+	if len(opts.MatchHash) > 0 && repoHash == opts.MatchHash {
+		return &FilesTar{
+			RepoHash:    repoHash,
+			NotModified: true,
+		}, nil
+	}
+
+	if len(rootPath) > 0 {
+		tree, err = tree.Tree(rootPath)
+		if err != nil {
+			if err == object.ErrDirectoryNotFound {
+				return &FilesTar{
+					RepoHash: repoHash,
+				}, nil
+			}
+			return nil, err
+		}
+	}
+
+	var files []*archiveFile
+	var itemHashes []string
+	fileIter := tree.Files()
+	defer fileIter.Close()
+	err = fileIter.ForEach(func(f *object.File) error {
+
+		if !includeFile(f.Name, opts) {
+			return nil
+		}
+
+		contents, err := f.Contents()
+		if err != nil {
+			return err
+		}
+
+		var mode int64 = 0644
+		if f.Mode == filemode.Executable {
+			mode = 0755
+		}
+
+		files = append(files, &archiveFile{
+			name:     f.Name,
+			mode:     mode,
+			contents: []byte(contents),
+		})
+		itemHashes = append(itemHashes, f.Hash.String())
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setModifiedTimes(repo, rh, rootPath, files)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = write(&buf, files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilesTar{
+		File:        &buf,
+		RepoHash:    repoHash,
+		ItemHashes:  itemHashes,
+		NotModified: false,
+	}, nil
+}
+
+// includeFile checks the file against the include and exclude patterns
+func includeFile(name string, opts *ArchiveOptions) bool {
+	included := len(opts.Include) == 0
+	for _, pattern := range opts.Include {
+		if ok, _ := matchPattern(pattern, name); ok {
+			included = true
+			break
+		}
+	}
+
+	if !included {
+		return false
+	}
+
+	for _, pattern := range opts.Exclude {
+		if ok, _ := matchPattern(pattern, name); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchPattern matches a glob against a file path, patterns without a slash
+// are matched against the file name alone so *.json matches at any depth
+func matchPattern(pattern string, name string) (bool, error) {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	return path.Match(pattern, name)
+}
+
+// setModifiedTimes sets the modification time of each file to the time of the
+// last commit that changed it, walking back through history until every
+// file has been found
+func setModifiedTimes(repo *git.Repository, from plumbing.Hash, root string, files []*archiveFile) error {
+	pending := make(map[string]*archiveFile)
+	for _, f := range files {
+		pending[path.Join(root, f.name)] = f
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	commits, err := historyIter(repo, from, true)
+	if err != nil {
+		return err
+	}
+	defer commits.Close()
+
+	err = commits.ForEach(func(c *object.Commit) error {
+		tree, err := c.Tree()
+		if err != nil {
+			return err
+		}
+
+		// the parents of a shallow commit are missing, its files are treated
+		// as added by it
+		var parentTree *object.Tree
+		if c.NumParents() > 0 {
+			parent, err := c.Parent(0)
+			if err != nil && err != plumbing.ErrObjectNotFound {
+				return err
+			}
+			if parent != nil {
+				parentTree, err = parent.Tree()
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range changes {
+			f, ok := pending[change.To.Name]
+			if !ok {
+				continue
+			}
+			f.modified = c.Committer.When
+			delete(pending, change.To.Name)
+		}
+
+		if len(pending) == 0 {
+			return storer.ErrStop
+		}
+		return nil
+	})
+
+	return err
+}
+
+var archiveWriters = map[string]func(w io.Writer, files []*archiveFile) error{
+	ArchiveTar:   writeTar,
+	ArchiveTarGz: writeTarGz,
+	ArchiveZip:   writeZip,
+}
+
+func writeTar(w io.Writer, files []*archiveFile) error {
+	result := tar.NewWriter(w)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Mode:     f.mode,
+			Size:     int64(len(f.contents)),
+			ModTime:  f.modified,
+		}
+
+		err := result.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if _, err := result.Write(f.contents); err != nil {
+			return err
+		}
+	}
+
+	return result.Close()
+}
+
+func writeTarGz(w io.Writer, files []*archiveFile) error {
+	gz := gzip.NewWriter(w)
+	err := writeTar(gz, files)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, files []*archiveFile) error {
+	result := zip.NewWriter(w)
+	for _, f := range files {
+		hdr := &zip.FileHeader{
+			Name:     f.name,
+			Method:   zip.Deflate,
+			Modified: f.modified,
+		}
+		hdr.SetMode(os.FileMode(f.mode))
+
+		fw, err := result.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fw.Write(f.contents); err != nil {
+			return err
+		}
+	}
+
+	return result.Close()
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// BlameLine is a line of a file along with the commit that last changed it
+type BlameLine struct {
+	// Line is the line number, starting at 1
+	Line   int       `json:"line"`
+	Hash   string    `json:"hash"`
+	Author string    `json:"author"`
+	Email  string    `json:"email"`
+	Date   time.Time `json:"date"`
+	Text   string    `json:"text"`
+}
+
+// BlameFile returns every line of a file at a revision with the commit that
+// last changed it. In shallow history lines older than the shallow boundary
+// are attributed to the shallow commit. Revisions are ordered by their commit
+// time, so commits to the file made within the same second may be confused.
+func BlameFile(db *proxy.DB, name string, rev string, path string) ([]*BlameLine, error) {
+	path = strings.Trim(path, "/")
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := resolveHashFromName(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	shallow, err := shallowCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := object.GetCommit(&shallowStorer{repo.Storer, shallow}, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := commit.File(path); err != nil {
+		if err == object.ErrFileNotFound {
+			return nil, errFileDoesNotExist
+		}
+		return nil, err
+	}
+
+	blame, err := git.Blame(commit, path)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make(map[plumbing.Hash]*object.Commit)
+	lines := make([]*BlameLine, len(blame.Lines))
+	for i, l := range blame.Lines {
+		c, ok := commits[l.Hash]
+		if !ok {
+			c, err = repo.CommitObject(l.Hash)
+			if err != nil {
+				return nil, err
+			}
+			commits[l.Hash] = c
+		}
+
+		lines[i] = &BlameLine{
+			Line:   i + 1,
+			Hash:   l.Hash.String(),
+			Author: c.Author.Name,
+			Email:  c.Author.Email,
+			Date:   c.Author.When,
+			Text:   l.Text,
+		}
+	}
+
+	return lines, nil
+}
+
+// shallowStorer hides the parents of shallow commits, so that history walks
+// which do not know about shallow history stop at them instead of failing to
+// read the missing parents
+type shallowStorer struct {
+	storer.EncodedObjectStorer
+	shallow map[plumbing.Hash]bool
+}
+
+func (s *shallowStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.EncodedObjectStorer.EncodedObject(t, h)
+	if err != nil || !s.shallow[h] || obj.Type() != plumbing.CommitObject {
+		return obj, err
+	}
+
+	c, err := object.DecodeCommit(s.EncodedObjectStorer, obj)
+	if err != nil {
+		return nil, err
+	}
+	c.ParentHashes = nil
+
+	root := &plumbing.MemoryObject{}
+	err = c.Encode(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// the commit keeps its own hash rather than that of its new content
+	return &hashedObject{root, h}, nil
+}
+
+// hashedObject is an object with a hash that does not match its content
+type hashedObject struct {
+	plumbing.EncodedObject
+	hash plumbing.Hash
+}
+
+func (o *hashedObject) Hash() plumbing.Hash {
+	return o.hash
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+)
+
+const bundleSignature = "# v2 git bundle"
+
+// packWindow is the number of objects considered as delta bases when a
+// packfile is written, the same as the git default
+const packWindow = 10
+
+// ExportBundle writes the references and the objects reachable from them as a
+// git bundle that can be imported into another database or with git itself.
+// All branches and tags are exported when no references are given. When since
+// is set, objects reachable from that commit are left out and the bundle can
+// only be imported into a repository that already has it.
+func ExportBundle(db *proxy.DB, name string, refs []string, since string) ([]byte, error) {
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	exported, err := bundleRefs(repo, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, bundleSignature)
+
+	var ignore []plumbing.Hash
+	if len(since) > 0 {
+		hash, err := resolveHashFromName(repo, since)
+		if err != nil {
+			return nil, err
+		}
+
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, errInvalidReference
+		}
+
+		ignore = append(ignore, hash)
+		fmt.Fprintf(&buf, "-%s %s\n", hash, strings.SplitN(commit.Message, "\n", 2)[0])
+	}
+
+	var tips []plumbing.Hash
+	for _, ref := range exported {
+		tips = append(tips, ref.Hash())
+		fmt.Fprintf(&buf, "%s %s\n", ref.Hash(), ref.Name())
+	}
+	fmt.Fprintln(&buf)
+
+	hashes, err := revlist.Objects(repo.Storer, tips, ignore)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = packfile.NewEncoder(&buf, repo.Storer, false).Encode(hashes, packWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// bundleRefs resolves the names of the references to export, a name may be a
+// full reference name or the short name of a branch or tag
+func bundleRefs(repo *git.Repository, names []string) ([]*plumbing.Reference, error) {
+	var refs []*plumbing.Reference
+
+	if len(names) == 0 {
+		iter, err := repo.References()
+		if err != nil {
+			return nil, err
+		}
+
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() == plumbing.HashReference && (ref.Name().IsBranch() || ref.Name().IsTag()) {
+				refs = append(refs, ref)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, n := range names {
+		var ref *plumbing.Reference
+		for _, candidate := range []string{n, "refs/heads/" + n, "refs/tags/" + n} {
+			r, err := repo.Reference(plumbing.ReferenceName(candidate), true)
+			if err == nil {
+				ref = plumbing.NewHashReference(plumbing.ReferenceName(candidate), r.Hash())
+				break
+			}
+			if err != plumbing.ErrReferenceNotFound {
+				return nil, err
+			}
+		}
+
+		if ref == nil {
+			return nil, &Error{fmt.Sprintf("reference %s doesn't exist", n), NotFound}
+		}
+		refs = append(refs, ref)
+	}
+
+	if len(refs) == 0 {
+		return nil, &Error{"no references to export", InvalidArgument}
+	}
+
+	return refs, nil
+}
+
+// ImportBundle adds the objects of a git bundle to the repository and updates
+// its references. References are only moved forward, a branch that has
+// commits which are not part of the bundle is a conflict. The references that
+// changed are returned.
+func ImportBundle(db *proxy.DB, name string, bundle io.Reader) ([]string, error) {
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(bundle)
+	prerequisites, refs, err := readBundleHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range prerequisites {
+		if _, err := repo.CommitObject(h); err != nil {
+			return nil, &Error{fmt.Sprintf("bundle requires commit %s which is not in the repository", h), NotFound}
+		}
+	}
+
+	err = packfile.UpdateObjectStorage(repo.Storer, r)
+	if err != nil {
+		return nil, &Error{fmt.Sprintf("invalid bundle: %s", err), InvalidArgument}
+	}
+
+	setReflog(repo, "bundle", "", "", "imported from a bundle")
+
+	var updated []string
+	for _, ref := range refs {
+		changed, err := fastForward(repo, ref)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			updated = append(updated, ref.Name().String())
+		}
+	}
+
+	return updated, nil
+}
+
+// readBundleHeader reads the prerequisite commits and references of a bundle,
+// leaving the reader at the start of the packfile
+func readBundleHeader(r *bufio.Reader) ([]plumbing.Hash, []*plumbing.Reference, error) {
+	errBundle := &Error{"invalid bundle header", InvalidArgument}
+
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != bundleSignature {
+		return nil, nil, &Error{"not a v2 git bundle", InvalidArgument}
+	}
+
+	var prerequisites []plumbing.Hash
+	var refs []*plumbing.Reference
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, nil, errBundle
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if len(line) == 0 {
+			return prerequisites, refs, nil
+		}
+
+		if strings.HasPrefix(line, "-") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 0 || !plumbing.IsHash(fields[0]) {
+				return nil, nil, errBundle
+			}
+			prerequisites = append(prerequisites, plumbing.NewHash(fields[0]))
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !plumbing.IsHash(fields[0]) {
+			return nil, nil, errBundle
+		}
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(fields[1]), plumbing.NewHash(fields[0])))
+	}
+}
+
+// fastForward sets the reference if it does not exist or the new target is a
+// descendant of the current one, returning false if it is already up to date
+func fastForward(repo *git.Repository, ref *plumbing.Reference) (bool, error) {
+	if ref.Name() == plumbing.HEAD {
+		return false, nil
+	}
+
+	if err := repo.Storer.HasEncodedObject(ref.Hash()); err != nil {
+		return false, &Error{fmt.Sprintf("bundle is missing %s for %s", ref.Hash(), ref.Name()), InvalidArgument}
+	}
+
+	current, err := repo.Reference(ref.Name(), false)
+	if err != nil && err != plumbing.ErrReferenceNotFound {
+		return false, err
+	}
+
+	var old plumbing.Hash
+	if err == nil {
+		old = current.Hash()
+		if current.Hash() == ref.Hash() {
+			return false, nil
+		}
+
+		ok, err := isAncestor(repo, current.Hash(), ref.Hash())
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, &Error{fmt.Sprintf("%s has diverged, %s is not a descendant of %s", ref.Name(), ref.Hash(), current.Hash()), Conflict}
+		}
+	}
+
+	return true, updateReference(repo, ref.Name(), old, ref.Hash())
+}
+
+// isAncestor checks if the first commit is reachable from the second, hashes
+// that are not commits such as annotated tags are never ancestors
+func isAncestor(repo *git.Repository, ancestor plumbing.Hash, descendant plumbing.Hash) (bool, error) {
+	a, err := repo.CommitObject(ancestor)
+	if err == plumbing.ErrObjectNotFound || err == plumbing.ErrInvalidType {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	d, err := repo.CommitObject(descendant)
+	if err == plumbing.ErrObjectNotFound || err == plumbing.ErrInvalidType {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return a.IsAncestor(d)
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// CherryPick applies the changes a commit made to its first parent onto
+// another branch. The original author is kept, the committer is the given
+// author and the message notes the commit it was picked from the way git
+// cherry-pick -x does. Files the branch has changed differently are reported
+// as a conflict and nothing is committed. Returns the hash of the new commit.
+func CherryPick(
+	db *proxy.DB,
+	name string,
+	rev string,
+	branch string,
+	author string,
+	email string) (string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := resolveHashFromName(repo, rev)
+	if err != nil {
+		return "", err
+	}
+
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return "", errInvalidReference
+		}
+		return "", err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	changes, err := commitFileChanges(commit)
+	if err != nil {
+		return "", err
+	}
+
+	tree, err := head.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	patch, conflicts, err := patchTree(tree, changes)
+	if err != nil {
+		return "", err
+	}
+	if len(conflicts) > 0 {
+		return "", conflictError(fmt.Sprintf("cherry pick %s onto %s", hash, branch), conflicts)
+	}
+	if len(patch) == 0 {
+		return "", &Error{fmt.Sprintf("the changes of %s are already on %s", hash, branch), Conflict}
+	}
+
+	treeHash, err := applyTreeChanges(repo.Storer, tree, patch)
+	if err != nil {
+		return "", err
+	}
+
+	message := fmt.Sprintf("%s\n\n(cherry picked from commit %s)\n", strings.TrimRight(commit.Message, "\n"), hash)
+	setReflog(repo, "cherry-pick", author, email, message)
+
+	c, err := commitTree(repo, branch, head.Hash, &object.Commit{
+		Author:       commit.Author,
+		Committer:    newSignature(author, email),
+		Message:      message,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{head.Hash},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return c.Hash.String(), nil
+}
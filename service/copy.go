@@ -0,0 +1,153 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// CopyPath copies a file or directory at a revision of one repository to a
+// path of a branch in another, replacing what was there in a single commit.
+// The objects are copied inside the database as they are stored and the
+// commit message ends with a Copied-from trailer naming the source
+// repository, commit and path. An empty source path copies the whole tree
+// and an empty message uses a default. Returns the hash of the new commit, or
+// of the branch head if the path already matches.
+func CopyPath(
+	db *proxy.DB,
+	srcName string,
+	srcRev string,
+	srcPath string,
+	dstName string,
+	dstBranch string,
+	dstPath string,
+	author string,
+	message string,
+	email string) (string, error) {
+
+	srcPath = strings.Trim(srcPath, "/")
+	dstPath = strings.Trim(dstPath, "/")
+
+	src, err := openRepo(db, false, srcName)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := openRepo(db, false, dstName)
+	if err != nil {
+		return "", err
+	}
+
+	tree, hash, err := resolveTreeFromName(src, srcRev)
+	if err != nil {
+		return "", err
+	}
+
+	entry := &object.TreeEntry{Mode: filemode.Dir, Hash: tree.Hash}
+	if len(srcPath) > 0 {
+		entry, err = treeEntry(tree, srcPath)
+		if err != nil {
+			return "", err
+		}
+		if entry == nil {
+			return "", errFileDoesNotExist
+		}
+	}
+	if len(dstPath) == 0 && entry.Mode != filemode.Dir {
+		return "", &Error{"a file cannot replace the whole tree, a destination path is required", InvalidArgument}
+	}
+
+	head, err := branchHead(dst, dstBranch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", dstBranch), NotFound}
+	}
+
+	headTree, err := head.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	current := &object.TreeEntry{Mode: filemode.Dir, Hash: headTree.Hash}
+	if len(dstPath) > 0 {
+		current, err = treeEntry(headTree, dstPath)
+		if err != nil {
+			return "", err
+		}
+	}
+	if sameEntry(entry, current) {
+		return head.Hash.String(), nil
+	}
+
+	file, err := fileInPath(headTree, dstPath)
+	if err != nil {
+		return "", err
+	}
+	if len(file) > 0 {
+		return "", &Error{fmt.Sprintf("cannot copy to %s, %s is a file", dstPath, file), Conflict}
+	}
+
+	objects, err := entryObjects(src, entry)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = dst.Storer.(*sqlstore.Storage).CopyObjects(src.Storer.(*sqlstore.Storage), objects)
+	if err != nil {
+		return "", err
+	}
+
+	if len(strings.TrimSpace(message)) == 0 {
+		message = fmt.Sprintf("Copy %s from %s", displayPath(dstPath), srcName)
+	}
+	message = fmt.Sprintf("%s\n\nCopied-from: %s %s %s\n", strings.TrimRight(message, "\n"), srcName, hash, displayPath(srcPath))
+
+	c, err := commitHeadChanges(dst, dstBranch, head, "copy", treeChanges{dstPath: entry}, message, author, email)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Hash.String(), nil
+}
+
+// entryObjects lists the trees and blobs below an entry. Objects the other
+// repository already has are included, copying waits for garbage collection
+// before it checks which ones are there, so an old unreachable copy that is
+// deleted in the meantime is copied again rather than left missing.
+func entryObjects(repo *git.Repository, entry *object.TreeEntry) ([]plumbing.Hash, error) {
+	var objects []plumbing.Hash
+	seen := make(map[plumbing.Hash]bool)
+
+	pending := []object.TreeEntry{*entry}
+	for len(pending) > 0 {
+		e := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if e.Mode == filemode.Submodule || seen[e.Hash] {
+			continue
+		}
+		seen[e.Hash] = true
+
+		objects = append(objects, e.Hash)
+		if e.Mode != filemode.Dir {
+			continue
+		}
+
+		tree, err := object.GetTree(repo.Storer, e.Hash)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, tree.Entries...)
+	}
+
+	return objects, nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// DefaultReflogExpiry is how long reflog entries are kept by garbage
+// collection when no expiry is given
+const DefaultReflogExpiry = "90 days"
+
+// GCResult summarises a garbage collection run
+type GCResult struct {
+	// Reachable is the number of objects reachable from a reference
+	Reachable int `json:"reachable"`
+	// Deleted is the number of unreachable objects deleted
+	Deleted int `json:"deleted"`
+	// Bytes is the storage reclaimed by the deleted objects
+	Bytes int64 `json:"bytes"`
+	// Pending is the number of unreachable objects kept for the grace period
+	// or because a kept object is stored as a delta of them
+	Pending int `json:"pending"`
+	// Expired is the number of reflog entries deleted for being older than the
+	// reflog expiry
+	Expired int `json:"expired"`
+}
+
+// CollectGarbage deletes objects that cannot be reached from any branch, tag
+// or reflog entry once they are older than the grace period, a Postgres
+// interval such as '1 day'. It waits for the transactions writing objects to
+// the repository to end first, the grace period protects objects that were
+// written by a transaction but have not been referenced yet. Reflog entries
+// older than the reflog expiry are deleted first, an empty expiry uses
+// DefaultReflogExpiry.
+func CollectGarbage(db *proxy.DB, name string, grace string, reflogExpiry string) (*GCResult, error) {
+	if len(reflogExpiry) == 0 {
+		reflogExpiry = DefaultReflogExpiry
+	}
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := repo.Storer.(*sqlstore.Storage).ExpireReflog(reflogExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := collectGarbage(repo, grace)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Expired = expired
+	return result, nil
+}
+
+func collectGarbage(repo *git.Repository, grace string) (*GCResult, error) {
+	err := repo.Storer.(*sqlstore.Storage).LockObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	reachable, err := reachableObjects(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(reachable))
+	for h := range reachable {
+		hashes = append(hashes, h)
+	}
+
+	pruned, err := repo.Storer.(*sqlstore.Storage).PruneObjects(hashes, grace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCResult{
+		Reachable: len(reachable),
+		Deleted:   pruned.Deleted,
+		Bytes:     pruned.Bytes,
+		Pending:   pruned.Pending,
+	}, nil
+}
+
+// rootObjects lists the targets of every reference along with every commit a
+// reference has pointed to according to the reflog, so that branches can
+// still be restored after they have been moved or deleted
+func rootObjects(repo *git.Repository) ([]plumbing.Hash, error) {
+	var roots []plumbing.Hash
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			roots = append(roots, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logged, err := repo.Storer.(*sqlstore.Storage).ReflogTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(roots, logged...), nil
+}
+
+// reachableObjects walks every reference and returns the set of objects they
+// lead to. The walk stops at shallow commits and missing objects are skipped
+// rather than treated as an error so that shallow history can still be
+// collected.
+func reachableObjects(repo *git.Repository) (map[plumbing.Hash]bool, error) {
+	reachable := make(map[plumbing.Hash]bool)
+
+	pending, err := rootObjects(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	shallow, err := shallowCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if reachable[h] {
+			continue
+		}
+
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		reachable[h] = true
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, c.TreeHash)
+			if !shallow[h] {
+				pending = append(pending, c.ParentHashes...)
+			}
+		case plumbing.TreeObject:
+			t, err := object.DecodeTree(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range t.Entries {
+				switch entry.Mode {
+				case filemode.Dir:
+					pending = append(pending, entry.Hash)
+				case filemode.Submodule:
+					// the commit belongs to another repository
+				default:
+					// blobs are not read, only marked
+					reachable[entry.Hash] = true
+				}
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, t.Target)
+		}
+	}
+
+	return reachable, nil
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	// ImportOverlay adds and updates files, leaving other files in place
+	ImportOverlay = "overlay"
+	// ImportSync makes the imported path identical to the files imported,
+	// deleting any file not part of the import
+	ImportSync = "sync"
+)
+
+// ImportTar commits the files of a tar archive below the prefix as a single
+// commit, see ImportFiles
+func ImportTar(
+	db *proxy.DB,
+	name string,
+	branch string,
+	prefix string,
+	archive io.Reader,
+	message string,
+	author string,
+	email string,
+	mode string,
+	repoHash string) (*FileInfo, error) {
+
+	files, err := readTar(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return ImportFiles(db, name, branch, prefix, files, message, author, email, mode, repoHash)
+}
+
+// ImportFiles commits the files below the prefix as a single commit. In
+// overlay mode existing files are kept, in sync mode files below the prefix
+// that are not part of the import are deleted. When repoHash is not empty the
+// import fails unless the branch still points to that commit.
+func ImportFiles(
+	db *proxy.DB,
+	name string,
+	branch string,
+	prefix string,
+	files []FileUpdate,
+	message string,
+	author string,
+	email string,
+	mode string,
+	repoHash string) (*FileInfo, error) {
+
+	if mode != ImportOverlay && mode != ImportSync {
+		return nil, &Error{fmt.Sprintf("invalid import mode %q, expected %s or %s", mode, ImportOverlay, ImportSync), InvalidArgument}
+	}
+
+	prefix = strings.Trim(prefix, "/")
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return nil, err
+	}
+	if len(repoHash) > 0 && (head == nil || head.Hash.String() != repoHash) {
+		return nil, errHashConflict
+	}
+
+	imported := make(treeChanges)
+	for _, f := range files {
+		p, err := cleanImportPath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		blob, err := writeBlob(repo.Storer, f.Content)
+		if err != nil {
+			return nil, err
+		}
+		imported[p] = &object.TreeEntry{Mode: filemode.Regular, Hash: blob}
+	}
+
+	changes := make(treeChanges)
+	if mode == ImportSync {
+		// build the imported tree on its own and replace the prefix with it
+		var entry *object.TreeEntry
+		if len(imported) > 0 {
+			h, err := applyTreeChanges(repo.Storer, nil, imported)
+			if err != nil {
+				return nil, err
+			}
+			entry = &object.TreeEntry{Mode: filemode.Dir, Hash: h}
+		}
+		changes[prefix] = entry
+	} else {
+		for p, entry := range imported {
+			changes[path.Join(prefix, p)] = entry
+		}
+	}
+
+	c, err := commitHeadChanges(repo, branch, head, "commit", changes, message, author, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		RepoHash: c.Hash.String(),
+	}, nil
+}
+
+// cleanImportPath normalises a path from an archive, rejecting paths that
+// would end up outside of the import prefix
+func cleanImportPath(p string) (string, error) {
+	cleaned := strings.Trim(path.Clean("/"+p), "/")
+	if len(cleaned) == 0 || cleaned != strings.Trim(strings.TrimPrefix(p, "./"), "/") {
+		return "", &Error{fmt.Sprintf("invalid path in archive: %s", p), InvalidArgument}
+	}
+	return cleaned, nil
+}
+
+// readTar reads the regular files of a tar archive
+func readTar(r io.Reader) ([]FileUpdate, error) {
+	var files []FileUpdate
+	archive := tar.NewReader(r)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, &Error{fmt.Sprintf("invalid archive: %s", err), InvalidArgument}
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		content, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, FileUpdate{Path: hdr.Name, Content: content})
+	}
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestImportTarExtension imports through both SQL signatures of import_tar,
+// with and without the expected head of the branch
+func TestImportTarExtension(t *testing.T) {
+	db := extensionDB(t)
+	name := fmt.Sprintf("import_tar_%d", time.Now().UnixNano())
+
+	if _, err := db.Exec("SELECT create_repository($1)", name); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("SELECT delete_repository($1)", name)
+
+	var data bytes.Buffer
+	w := tar.NewWriter(&data)
+	content := []byte(`{"max": 42}`)
+	err := w.WriteHeader(&tar.Header{Name: "config.json", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	w.Close()
+
+	var head string
+	err = db.QueryRow("SELECT import_tar($1, 'master', 'app', $2, 'test', 'import', 'test@example.com', 'sync')", name, data.Bytes()).Scan(&head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("SELECT import_tar($1, 'master', 'app', $2, 'test', 'import', 'test@example.com', 'sync', $3)", name, data.Bytes(), "0000000000000000000000000000000000000000")
+	if err == nil {
+		t.Error("imported onto a head other than the expected one")
+	}
+
+	_, err = db.Exec("SELECT import_tar($1, 'master', 'app', $2, 'test', 'import', 'test@example.com', 'overlay', $3)", name, data.Bytes(), head)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
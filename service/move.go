@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// MovePath moves a file or directory of a branch to a new path in a single
+// commit, the content is not rewritten so the log and diffs can follow the
+// move as a rename. The new path must not exist yet and an empty message uses
+// a default. Returns the hash of the new commit.
+func MovePath(
+	db *proxy.DB,
+	name string,
+	branch string,
+	from string,
+	to string,
+	author string,
+	message string,
+	email string) (string, error) {
+
+	from = strings.Trim(from, "/")
+	to = strings.Trim(to, "/")
+	if len(from) == 0 || len(to) == 0 {
+		return "", &Error{"a path is required, the whole tree cannot be moved", InvalidArgument}
+	}
+	if from == to || strings.HasPrefix(to, from+"/") {
+		return "", &Error{fmt.Sprintf("cannot move %s to %s, a path cannot be moved into itself", from, to), InvalidArgument}
+	}
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	tree, err := head.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := treeEntry(tree, from)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return "", errFileDoesNotExist
+	}
+
+	existing, err := treeEntry(tree, to)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", &Error{fmt.Sprintf("cannot move %s to %s, %s already exists", from, to, to), Conflict}
+	}
+
+	file, err := fileInPath(tree, to)
+	if err != nil {
+		return "", err
+	}
+	if len(file) > 0 {
+		return "", &Error{fmt.Sprintf("cannot move %s to %s, %s is a file", from, to, file), Conflict}
+	}
+
+	if len(message) == 0 {
+		message = fmt.Sprintf("Move %s to %s", from, to)
+	}
+
+	c, err := commitHeadChanges(repo, branch, head, "move", treeChanges{from: nil, to: entry}, message, author, email)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Hash.String(), nil
+}
+
+// fileInPath returns the first parent directory of a path that is a file in
+// the tree, which committing the path would replace, or an empty string if
+// there is none
+func fileInPath(tree *object.Tree, path string) (string, error) {
+	parts := strings.Split(path, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		e, err := treeEntry(tree, dir)
+		if err != nil {
+			return "", err
+		}
+		if e == nil {
+			return "", nil
+		}
+		if e.Mode.IsFile() {
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+// followIter filters a history walk to the commits that changed a path
+// compared to their first parent. When a commit added the path as the rename
+// of another file or directory the older commits are matched against the
+// previous path, so the history continues across moves.
+type followIter struct {
+	repo   *git.Repository
+	source object.CommitIter
+	path   string
+}
+
+// newFollowIter follows the history of a path through the commits of source
+func newFollowIter(repo *git.Repository, source object.CommitIter, path string) object.CommitIter {
+	return &followIter{repo: repo, source: source, path: strings.Trim(path, "/")}
+}
+
+func (f *followIter) Next() (*object.Commit, error) {
+	for {
+		c, err := f.source.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		changed, err := f.changed(c)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			return c, nil
+		}
+	}
+}
+
+// changed reports if a commit changed the path, moving on to the previous
+// path if the commit renamed it
+func (f *followIter) changed(c *object.Commit) (bool, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return false, err
+	}
+
+	// the parent of a shallow commit is missing and treated as empty
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := f.repo.CommitObject(c.ParentHashes[0])
+		if err != nil && err != plumbing.ErrObjectNotFound {
+			return false, err
+		}
+		if parent != nil {
+			parentTree, err = parent.Tree()
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	entry, err := treeEntry(tree, f.path)
+	if err != nil {
+		return false, err
+	}
+	previous, err := treeEntry(parentTree, f.path)
+	if err != nil {
+		return false, err
+	}
+
+	if sameEntry(entry, previous) {
+		return false, nil
+	}
+	if entry == nil || previous != nil {
+		return true, nil
+	}
+
+	renamed, err := renamedFrom(parentTree, tree, f.path)
+	if err != nil {
+		return false, err
+	}
+	if len(renamed) > 0 {
+		f.path = renamed
+	}
+	return true, nil
+}
+
+func (f *followIter) ForEach(cb func(*object.Commit) error) error {
+	for {
+		c, err := f.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = cb(c)
+		if err == storer.ErrStop {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *followIter) Close() {
+	f.source.Close()
+}
+
+// renamedFrom returns the path that a file or directory added between two
+// trees was renamed from, or an empty string if it is new. A directory is
+// renamed from the directory most of its files came from, as long as that
+// directory no longer exists.
+func renamedFrom(from *object.Tree, to *object.Tree, path string) (string, error) {
+	if from == nil {
+		return "", nil
+	}
+
+	changes, err := object.DiffTreeWithOptions(context.Background(), from, to, object.DefaultDiffTreeOptions)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := path + "/"
+	votes := make(map[string]int)
+	for _, c := range changes {
+		if len(c.From.Name) == 0 || c.From.Name == c.To.Name {
+			continue
+		}
+
+		source := ""
+		switch {
+		case c.To.Name == path:
+			return c.From.Name, nil
+		case strings.HasPrefix(c.To.Name, prefix):
+			// the old directory is the old path less the part below path
+			rest := c.To.Name[len(prefix):]
+			if strings.HasSuffix(c.From.Name, "/"+rest) {
+				source = strings.TrimSuffix(c.From.Name, "/"+rest)
+			}
+		}
+		if len(source) == 0 {
+			continue
+		}
+
+		votes[source]++
+	}
+
+	best := ""
+	for source, n := range votes {
+		if n < votes[best] || n == votes[best] && source > best {
+			continue
+		}
+
+		// a directory that still exists was not renamed, files were moved out
+		// of it
+		e, err := treeEntry(to, source)
+		if err != nil {
+			return "", err
+		}
+		if e == nil {
+			best = source
+		}
+	}
+
+	return best, nil
+}
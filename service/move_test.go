@@ -0,0 +1,128 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// settings returns file content long enough for rename detection to compare,
+// distinct for each name
+func settings(name string) string {
+	var b strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&b, "%s.setting%d = %d\n", name, i, i*7)
+	}
+	return b.String()
+}
+
+func TestRenamedFrom(t *testing.T) {
+	tests := []struct {
+		name string
+		// from is nil for a commit without a parent
+		from map[string]string
+		to   map[string]string
+		path string
+		want string
+	}{
+		{
+			name: "no parent",
+			to:   map[string]string{"a.json": settings("a")},
+			path: "a.json",
+			want: "",
+		},
+		{
+			name: "new file",
+			from: map[string]string{"a.json": settings("a")},
+			to:   map[string]string{"a.json": settings("a"), "b.json": settings("b")},
+			path: "b.json",
+			want: "",
+		},
+		{
+			name: "file renamed",
+			from: map[string]string{"app/a.json": settings("a"), "b.json": settings("b")},
+			to:   map[string]string{"web/config.json": settings("a"), "b.json": settings("b")},
+			path: "web/config.json",
+			want: "app/a.json",
+		},
+		{
+			name: "file renamed and edited",
+			from: map[string]string{"a.json": settings("a")},
+			to:   map[string]string{"c.json": settings("a") + "extra = 1\n"},
+			path: "c.json",
+			want: "a.json",
+		},
+		{
+			name: "file replaced by unrelated content",
+			from: map[string]string{"a.json": settings("a")},
+			to:   map[string]string{"c.json": settings("c")},
+			path: "c.json",
+			want: "",
+		},
+		{
+			name: "copy of a file that still exists",
+			from: map[string]string{"a.json": settings("a")},
+			to:   map[string]string{"a.json": settings("a"), "c.json": settings("a")},
+			path: "c.json",
+			want: "",
+		},
+		{
+			name: "directory renamed",
+			from: map[string]string{"app/a.json": settings("a"), "app/sub/b.json": settings("b")},
+			to:   map[string]string{"web/a.json": settings("a"), "web/sub/b.json": settings("b")},
+			path: "web",
+			want: "app",
+		},
+		{
+			name: "directory moved into another",
+			from: map[string]string{"app/a.json": settings("a"), "app/b.json": settings("b")},
+			to:   map[string]string{"apps/web/a.json": settings("a"), "apps/web/b.json": settings("b")},
+			path: "apps/web",
+			want: "app",
+		},
+		{
+			name: "directory made of files from several directories",
+			from: map[string]string{"x/a.json": settings("a"), "y/b.json": settings("b"), "y/c.json": settings("c")},
+			to:   map[string]string{"z/a.json": settings("a"), "z/b.json": settings("b"), "z/c.json": settings("c")},
+			path: "z",
+			want: "y",
+		},
+		{
+			name: "files moved out of a directory that still exists",
+			from: map[string]string{"app/a.json": settings("a"), "app/b.json": settings("b"), "app/c.json": settings("c")},
+			to:   map[string]string{"app/c.json": settings("c"), "web/a.json": settings("a"), "web/b.json": settings("b")},
+			path: "web",
+			want: "",
+		},
+		{
+			name: "directory whose files were renamed as well",
+			from: map[string]string{"app/a.json": settings("a")},
+			to:   map[string]string{"web/b.json": settings("a")},
+			path: "web",
+			want: "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := memory.NewStorage()
+
+			var from *object.Tree
+			if test.from != nil {
+				from = buildTree(t, s, test.from)
+			}
+			to := buildTree(t, s, test.to)
+
+			got, err := renamedFrom(from, to, test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// fileChange is a change to a single file, a nil entry means the file does
+// not exist on that side
+type fileChange struct {
+	path string
+	from *object.TreeEntry
+	to   *object.TreeEntry
+}
+
+// inverse returns the change that undoes this one
+func (c fileChange) inverse() fileChange {
+	return fileChange{path: c.path, from: c.to, to: c.from}
+}
+
+// commitFileChanges lists the files a commit changed compared to its first
+// parent, or every file for a commit without parents
+func commitFileChanges(commit *object.Commit) ([]fileChange, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return diffFileChanges(parentTree, tree)
+}
+
+// diffFileChanges lists the files that differ between two trees, either tree
+// may be nil for an empty tree
+func diffFileChanges(from *object.Tree, to *object.Tree) ([]fileChange, error) {
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]fileChange, 0, len(changes))
+	for _, c := range changes {
+		fc := fileChange{path: c.From.Name}
+		if len(c.From.Name) > 0 {
+			e := c.From.TreeEntry
+			fc.from = &e
+		}
+		if len(c.To.Name) > 0 {
+			fc.path = c.To.Name
+			e := c.To.TreeEntry
+			fc.to = &e
+		}
+		result = append(result, fc)
+	}
+
+	return result, nil
+}
+
+// patchTree converts file changes to the tree changes that apply them to a
+// tree, which may be nil for an empty tree. A file that no longer matches the
+// from side of its change has been changed since and is returned as a
+// conflict, files that already match the to side are left as they are.
+func patchTree(tree *object.Tree, changes []fileChange) (treeChanges, []string, error) {
+	patch := make(treeChanges)
+	var conflicts []string
+
+	for _, c := range changes {
+		current, err := treeEntry(tree, c.path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if sameEntry(current, c.to) {
+			continue
+		}
+		if !sameEntry(current, c.from) {
+			conflicts = append(conflicts, c.path)
+			continue
+		}
+
+		if c.to == nil {
+			patch[c.path] = nil
+		} else {
+			patch[c.path] = &object.TreeEntry{Mode: c.to.Mode, Hash: c.to.Hash}
+		}
+	}
+
+	sort.Strings(conflicts)
+	return patch, conflicts, nil
+}
+
+// treeEntry finds the entry of a file, nil if it does not exist
+func treeEntry(tree *object.Tree, path string) (*object.TreeEntry, error) {
+	if tree == nil {
+		return nil, nil
+	}
+
+	e, err := tree.FindEntry(path)
+	if err == object.ErrEntryNotFound || err == object.ErrDirectoryNotFound {
+		return nil, nil
+	}
+	return e, err
+}
+
+func sameEntry(a *object.TreeEntry, b *object.TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Mode == b.Mode && a.Hash == b.Hash
+}
+
+// conflictError reports the files that prevent changes from being applied
+func conflictError(action string, conflicts []string) error {
+	return &Error{fmt.Sprintf("cannot %s, changed since: %s", action, strings.Join(conflicts, ", ")), Conflict}
+}
+
+// subject returns the first line of a commit message
+func subject(message string) string {
+	message = strings.TrimSpace(message)
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		return message[:i]
+	}
+	return message
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// DiffSummary lists the files changed by a commit
+type DiffSummary struct {
+	// Commit is the new commit, or the branch head if nothing changed
+	Commit   string   `json:"commit"`
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
+}
+
+// PromotePath makes a file or directory of one branch identical to the same
+// path of another branch in a single commit, files missing from the source
+// are deleted. An empty path promotes the whole tree.
+func PromotePath(
+	db *proxy.DB,
+	name string,
+	fromBranch string,
+	toBranch string,
+	path string,
+	author string,
+	message string,
+	email string) (*DiffSummary, error) {
+
+	path = strings.Trim(path, "/")
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	from, _, err := resolveTreeFromName(repo, fromBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message) == 0 {
+		message = fmt.Sprintf("Promote %s from %s", displayPath(path), fromBranch)
+	}
+
+	head, c, err := commitPathFrom(repo, toBranch, from, path, "promote", message, author, email)
+	if err != nil {
+		return nil, err
+	}
+
+	return summarizeCommit(head, c)
+}
+
+// summarizeCommit lists the files that differ between two commits
+func summarizeCommit(from *object.Commit, to *object.Commit) (*DiffSummary, error) {
+	summary := &DiffSummary{
+		Commit:   to.Hash.String(),
+		Added:    []string{},
+		Modified: []string{},
+		Deleted:  []string{},
+	}
+
+	if from.Hash == to.Hash {
+		return summary, nil
+	}
+
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := diffFileChanges(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range changes {
+		switch {
+		case c.from == nil:
+			summary.Added = append(summary.Added, c.path)
+		case c.to == nil:
+			summary.Deleted = append(summary.Deleted, c.path)
+		default:
+			summary.Modified = append(summary.Modified, c.path)
+		}
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// PurgeResult summarises the effect of PurgePath
+type PurgeResult struct {
+	// Commits is the number of commits rewritten
+	Commits int `json:"commits"`
+	// Refs lists the branches and tags that were moved to rewritten commits
+	Refs []string `json:"refs"`
+	// Deleted is the number of objects deleted from the database
+	Deleted int `json:"deleted"`
+	// Bytes is the storage reclaimed by the deleted objects
+	Bytes int64 `json:"bytes"`
+}
+
+// PurgePath removes a file or directory from every commit reachable from a
+// branch, tag or reflog entry, the way git filter-branch does. Commits that
+// contained the path are rewritten along with every commit that follows
+// them, annotated tags are rewritten to point at the new commits and their
+// signatures are dropped. Shallow commits keep their pruned parents and the
+// shallow boundary moves to their rewritten versions. References and the
+// reflog are moved to the rewritten history and every object that is no
+// longer reachable is deleted straight away, ignoring the grace period of
+// garbage collection, so the old content does not stay in the database.
+func PurgePath(db *proxy.DB, name string, path string) (*PurgeResult, error) {
+	path = strings.Trim(path, "/")
+	if len(path) == 0 {
+		return nil, &Error{"a path is required, the whole tree cannot be purged", InvalidArgument}
+	}
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	shallow, err := shallowCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	s := repo.Storer.(*sqlstore.Storage)
+	r := &historyRewriter{repo: repo, path: path, shallow: shallow, rewritten: make(map[plumbing.Hash]plumbing.Hash)}
+	result := &PurgeResult{Refs: []string{}}
+
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var moved []*plumbing.Reference
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		h, err := r.rewrite(ref.Hash())
+		if err != nil {
+			return err
+		}
+		if h != ref.Hash() {
+			moved = append(moved, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	logged, err := s.ReflogTargets()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range logged {
+		_, err = r.rewrite(h)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	setReflog(repo, "purge", "", "", fmt.Sprintf("purged %s", path))
+	for _, ref := range moved {
+		err = updateReference(repo, ref.Name(), ref.Hash(), r.rewritten[ref.Hash()])
+		if err != nil {
+			return nil, err
+		}
+		result.Refs = append(result.Refs, ref.Name().String())
+	}
+	sort.Strings(result.Refs)
+
+	// the shallow boundary moves to the rewritten commits, the old ones are
+	// about to be deleted
+	if len(shallow) > 0 {
+		boundary := make([]plumbing.Hash, 0, len(shallow))
+		for h := range shallow {
+			if n, ok := r.rewritten[h]; ok {
+				h = n
+			}
+			boundary = append(boundary, h)
+		}
+		sort.Slice(boundary, func(i, j int) bool {
+			return boundary[i].String() < boundary[j].String()
+		})
+
+		err = s.SetShallow(boundary)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the reflog is rewritten last so that the entries just written for the
+	// moved references no longer lead to the old commits either
+	err = s.RewriteReflog(r.rewritten)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.LockObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	reachable, err := reachableObjects(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(reachable))
+	for h := range reachable {
+		hashes = append(hashes, h)
+	}
+
+	// a kept object stored as a delta of a purged one would keep it alive
+	_, err = s.InflateDeltas(hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned, err := s.PruneObjects(hashes, "0 seconds")
+	if err != nil {
+		return nil, err
+	}
+
+	result.Commits = r.commits
+	result.Deleted = pruned.Deleted
+	result.Bytes = pruned.Bytes
+	return result, nil
+}
+
+// historyRewriter rewrites commits and annotated tags without a path
+type historyRewriter struct {
+	repo *git.Repository
+	path string
+	// shallow commits are rewritten but keep the parents that were pruned
+	shallow   map[plumbing.Hash]bool
+	rewritten map[plumbing.Hash]plumbing.Hash
+	commits   int
+}
+
+// rewrite returns the hash an object has once the path has been removed from
+// its history, parents are rewritten before their children without
+// recursion so that long histories cannot exhaust the stack. The walk stops at
+// shallow commits and missing objects are kept as they are.
+func (r *historyRewriter) rewrite(root plumbing.Hash) (plumbing.Hash, error) {
+	pending := []plumbing.Hash{root}
+
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		if _, ok := r.rewritten[h]; ok {
+			pending = pending[:len(pending)-1]
+			continue
+		}
+
+		obj, err := r.repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err == plumbing.ErrObjectNotFound {
+			r.rewritten[h] = h
+			continue
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(r.repo.Storer, obj)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+
+			ready := true
+			for _, p := range r.parents(c) {
+				if _, ok := r.rewritten[p]; !ok {
+					pending = append(pending, p)
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+
+			r.rewritten[h], err = r.commit(c)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(r.repo.Storer, obj)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+
+			if _, ok := r.rewritten[t.Target]; !ok {
+				pending = append(pending, t.Target)
+				continue
+			}
+
+			r.rewritten[h], err = r.tag(t)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+		default:
+			r.rewritten[h] = h
+		}
+	}
+
+	return r.rewritten[root], nil
+}
+
+// parents returns the parents of a commit that are rewritten with it, none
+// for a shallow commit
+func (r *historyRewriter) parents(c *object.Commit) []plumbing.Hash {
+	if r.shallow[c.Hash] {
+		return nil
+	}
+	return c.ParentHashes
+}
+
+// commit writes the commit without the path and with its rewritten parents,
+// a commit that is unchanged keeps its hash
+func (r *historyRewriter) commit(c *object.Commit) (plumbing.Hash, error) {
+	changed := false
+	parents := append([]plumbing.Hash(nil), c.ParentHashes...)
+	for i, p := range r.parents(c) {
+		parents[i] = r.rewritten[p]
+		changed = changed || parents[i] != p
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	treeHash := c.TreeHash
+	entry, err := treeEntry(tree, r.path)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if entry != nil {
+		treeHash, err = applyTreeChanges(r.repo.Storer, tree, treeChanges{r.path: nil})
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		changed = true
+	}
+
+	if !changed {
+		return c.Hash, nil
+	}
+
+	r.commits++
+	return writeCommit(r.repo.Storer, &object.Commit{
+		Author:       c.Author,
+		Committer:    c.Committer,
+		Message:      c.Message,
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	})
+}
+
+// tag writes the tag pointing at its rewritten target, a tag whose target is
+// unchanged keeps its hash
+func (r *historyRewriter) tag(t *object.Tag) (plumbing.Hash, error) {
+	target := r.rewritten[t.Target]
+	if target == t.Target {
+		return t.Hash, nil
+	}
+
+	return writeTag(r.repo.Storer, &object.Tag{
+		Name:       t.Name,
+		Tagger:     t.Tagger,
+		Message:    t.Message,
+		TargetType: t.TargetType,
+		Target:     target,
+	})
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// RebaseBranch replays the commits of a branch that are not reachable from
+// onto on top of it, oldest first. Commits whose changes are already on the
+// new base are dropped and a merge commit is replayed as the changes it made
+// to its first parent. Authors are kept and the given author becomes the
+// committer of the replayed commits. The branch is only moved once every
+// commit has been replayed and the previous head is recorded in the reflog so
+// restore_branch can undo the rebase. Returns the new head of the branch.
+func RebaseBranch(
+	db *proxy.DB,
+	name string,
+	branch string,
+	onto string,
+	author string,
+	email string) (string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	base, err := resolveCommit(repo, onto)
+	if err != nil {
+		return "", err
+	}
+
+	upToDate, err := isAncestor(repo, base.Hash, head.Hash)
+	if err != nil {
+		return "", err
+	}
+	if upToDate {
+		return head.Hash.String(), nil
+	}
+
+	commits, err := commitsSince(repo, head, base.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	current := base
+	for _, c := range commits {
+		current, err = replayCommit(repo, current, c, newSignature(author, email))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	setReflog(repo, "rebase", author, email, fmt.Sprintf("rebase %s onto %s", branch, onto))
+	err = updateReference(repo, refName(branch), head.Hash, current.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	return current.Hash.String(), nil
+}
+
+// replayCommit applies the changes of a commit on top of parent as committer,
+// returning parent unchanged if there is nothing left to apply
+func replayCommit(repo *git.Repository, parent *object.Commit, c *object.Commit, committer object.Signature) (*object.Commit, error) {
+	changes, err := commitFileChanges(c)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := parent.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	patch, conflicts, err := patchTree(tree, changes)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		return nil, conflictError(fmt.Sprintf("replay %s (%s)", c.Hash, subject(c.Message)), conflicts)
+	}
+	if len(patch) == 0 {
+		return parent, nil
+	}
+
+	treeHash, err := applyTreeChanges(repo.Storer, tree, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := writeCommit(repo.Storer, &object.Commit{
+		Author:       c.Author,
+		Committer:    committer,
+		Message:      c.Message,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{parent.Hash},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.CommitObject(h)
+}
+
+// SquashBranch replaces the commits of a branch after sinceRev with a single
+// commit of the same tree whose parent is sinceRev. The author of the oldest
+// squashed commit is kept, the given author is the committer and an empty
+// message combines the messages of the squashed commits. The previous head is
+// recorded in the reflog so restore_branch can undo the squash. Returns the
+// new head of the branch.
+func SquashBranch(
+	db *proxy.DB,
+	name string,
+	branch string,
+	sinceRev string,
+	message string,
+	author string,
+	email string) (string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	since, err := resolveCommit(repo, sinceRev)
+	if err != nil {
+		return "", err
+	}
+
+	if since.Hash == head.Hash {
+		return "", &Error{fmt.Sprintf("nothing to squash, %s is the head of %s", sinceRev, branch), InvalidArgument}
+	}
+
+	ok, err := isAncestor(repo, since.Hash, head.Hash)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", &Error{fmt.Sprintf("%s is not an ancestor of %s", sinceRev, branch), InvalidArgument}
+	}
+
+	commits, err := commitsSince(repo, head, since.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	if len(strings.TrimSpace(message)) == 0 {
+		messages := make([]string, len(commits))
+		for i, c := range commits {
+			messages[i] = strings.TrimSpace(c.Message)
+		}
+		message = strings.Join(messages, "\n\n")
+	}
+	message = strings.TrimSpace(message) + "\n"
+
+	setReflog(repo, "squash", author, email, fmt.Sprintf("squash %d commits of %s since %s", len(commits), branch, sinceRev))
+	c, err := commitTree(repo, branch, head.Hash, &object.Commit{
+		Author:       commits[0].Author,
+		Committer:    newSignature(author, email),
+		Message:      message,
+		TreeHash:     head.TreeHash,
+		ParentHashes: []plumbing.Hash{since.Hash},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return c.Hash.String(), nil
+}
+
+// commitsSince lists the commits on the first parent chain of head that are
+// not reachable from base, oldest first
+func commitsSince(repo *git.Repository, head *object.Commit, base plumbing.Hash) ([]*object.Commit, error) {
+	var commits []*object.Commit
+
+	c := head
+	for {
+		reachable, err := isAncestor(repo, c.Hash, base)
+		if err != nil {
+			return nil, err
+		}
+		if reachable {
+			break
+		}
+
+		commits = append(commits, c)
+		if c.NumParents() == 0 {
+			break
+		}
+
+		c, err = c.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, nil
+}
+
+// resolveCommit finds the commit a revision points to
+func resolveCommit(repo *git.Repository, rev string) (*object.Commit, error) {
+	hash, err := resolveHashFromName(repo, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := repo.CommitObject(hash)
+	if err == plumbing.ErrObjectNotFound || err == plumbing.ErrInvalidType {
+		return nil, errInvalidReference
+	}
+	return c, err
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestRebaseBranchExtension rebases and squashes through the SQL signatures
+// that leave out the author, the database user becomes the committer
+func TestRebaseBranchExtension(t *testing.T) {
+	db := extensionDB(t)
+	name := fmt.Sprintf("rebase_branch_%d", time.Now().UnixNano())
+
+	if _, err := db.Exec("SELECT create_repository($1)", name); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("SELECT delete_repository($1)", name)
+
+	steps := []string{
+		"SELECT commit_file($1, 'a.json', '{}', 'test', 'add a', 'test@example.com')",
+		"SELECT create_branch($1, 'master', 'feature')",
+		"SELECT commit_branch_file($1, 'feature', 'b.json', '{}', 'test', 'add b', 'test@example.com')",
+		"SELECT commit_branch_file($1, 'feature', 'c.json', '{}', 'test', 'add c', 'test@example.com')",
+		"SELECT commit_file($1, 'd.json', '{}', 'test', 'add d', 'test@example.com')",
+		"SELECT rebase_branch($1, 'feature', 'master')",
+		"SELECT squash_branch($1, 'feature', 'master', 'add b and c')",
+	}
+	for _, step := range steps {
+		if _, err := db.Exec(step, name); err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+	}
+
+	var user, who, operation string
+	err := db.QueryRow("SELECT session_user, e ->> 'who', e ->> 'operation' FROM (SELECT get_reflog($1, 'feature')::jsonb -> 0 AS e) r", name).Scan(&user, &who, &operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if who != user || operation != "squash" {
+		t.Errorf("%s recorded as %q, want a squash by %q", operation, who, user)
+	}
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// GetReflog lists the recorded movements of a branch or tag, newest first.
+// Short names are looked up as a branch and then as a tag, references that
+// have been deleted still have their reflog.
+func GetReflog(db *proxy.DB, name string, ref string) ([]*sqlstore.ReflogEntry, error) {
+	s, err := sqlstore.NewStorage(db, name)
+	if err != nil {
+		return nil, errDoesNotExist
+	}
+
+	candidates := []plumbing.ReferenceName{plumbing.ReferenceName(ref)}
+	if ref != plumbing.HEAD.String() && !strings.HasPrefix(ref, "refs/") {
+		candidates = []plumbing.ReferenceName{
+			plumbing.NewBranchReferenceName(ref),
+			plumbing.NewTagReferenceName(ref),
+		}
+	}
+
+	for _, n := range candidates {
+		entries, err := s.Reflog(n)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			return entries, nil
+		}
+	}
+
+	return []*sqlstore.ReflogEntry{}, nil
+}
+
+// RestoreBranch moves a branch back to where it pointed after a reflog entry,
+// recreating it if it has since been deleted. Restoring the entry that
+// deleted the branch restores it to where it pointed before it was deleted.
+// The restored commit is returned.
+func RestoreBranch(db *proxy.DB, name string, branch string, entryID int64) (string, error) {
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	s := repo.Storer.(*sqlstore.Storage)
+	entry, err := s.ReflogEntry(entryID)
+	if err != nil {
+		return "", err
+	}
+
+	ref := refName(branch)
+	if entry == nil || entry.Name != ref.String() {
+		return "", &Error{fmt.Sprintf("reflog entry %d is not an entry of %s", entryID, ref.Short()), NotFound}
+	}
+
+	target := entry.New
+	if len(target) == 0 {
+		target = entry.Old
+	}
+
+	hash := plumbing.NewHash(target)
+	if _, err := repo.CommitObject(hash); err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return "", &Error{fmt.Sprintf("commit %s no longer exists", target), NotFound}
+		}
+		return "", err
+	}
+
+	var old plumbing.Hash
+	current, err := repo.Reference(ref, false)
+	if err == nil {
+		old = current.Hash()
+	} else if err != plumbing.ErrReferenceNotFound {
+		return "", err
+	}
+
+	if old == hash {
+		return hash.String(), nil
+	}
+
+	setReflog(repo, "restore", "", "", fmt.Sprintf("restored to reflog entry %d", entryID))
+	err = updateReference(repo, ref, old, hash)
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
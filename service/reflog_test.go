@@ -0,0 +1,43 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestDeleteBranchExtension deletes a branch through SQL, the reflog records
+// the deletion and deleting the branch again fails
+func TestDeleteBranchExtension(t *testing.T) {
+	db := extensionDB(t)
+	name := fmt.Sprintf("delete_branch_%d", time.Now().UnixNano())
+
+	if _, err := db.Exec("SELECT create_repository($1)", name); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("SELECT delete_repository($1)", name)
+
+	steps := []string{
+		"SELECT commit_file($1, 'a.json', '{}', 'test', 'add a', 'test@example.com')",
+		"SELECT create_branch($1, 'master', 'feature')",
+		"SELECT delete_branch($1, 'feature')",
+	}
+	for _, step := range steps {
+		if _, err := db.Exec(step, name); err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+	}
+
+	var user, who, operation string
+	err := db.QueryRow("SELECT session_user, e ->> 'who', e ->> 'operation' FROM (SELECT get_reflog($1, 'feature')::jsonb -> 0 AS e) r", name).Scan(&user, &who, &operation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if who != user || operation != "delete" {
+		t.Errorf("%s recorded as %q, want a delete by %q", operation, who, user)
+	}
+
+	if _, err := db.Exec("SELECT delete_branch($1, 'feature')", name); err == nil {
+		t.Error("deleted a missing branch")
+	}
+}
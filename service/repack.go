@@ -0,0 +1,175 @@
+package service
+
+import (
+	"path"
+	"sort"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// RepackResult summarises a repack
+type RepackResult struct {
+	// Objects is the number of objects rewritten
+	Objects int `json:"objects"`
+	// Deltas is the number of objects stored as a delta
+	Deltas int `json:"deltas"`
+	// BytesBefore is the storage used by the repository before the repack
+	BytesBefore int64 `json:"bytes_before"`
+	// BytesAfter is the storage used by the repository after the repack
+	BytesAfter int64 `json:"bytes_after"`
+}
+
+// Repack stores the versions of each file as deltas against the next newer
+// version, the way git packfiles do, which greatly reduces the storage used
+// by files that are edited often. Objects are decoded transparently so this
+// only changes how much space the repository takes.
+func Repack(db *proxy.DB, name string) (*RepackResult, error) {
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	chains, err := blobChains(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := repo.Storer.(*sqlstore.Storage).Repack(chains)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RepackResult{
+		Objects:     result.Objects,
+		Deltas:      result.Deltas,
+		BytesBefore: result.BytesBefore,
+		BytesAfter:  result.BytesAfter,
+	}, nil
+}
+
+// blobChains lists the versions of every file reachable from the references,
+// newest first. A blob belongs to the chain of the first path it is found at.
+func blobChains(repo *git.Repository) ([][]plumbing.Hash, error) {
+	commits, err := reachableCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(commits, func(i, j int) bool {
+		return commits[i].Committer.When.After(commits[j].Committer.When)
+	})
+
+	var paths []string
+	chains := make(map[string][]plumbing.Hash)
+	blobs := make(map[plumbing.Hash]bool)
+	trees := make(map[plumbing.Hash]bool)
+
+	var walk func(h plumbing.Hash, dir string) error
+	walk = func(h plumbing.Hash, dir string) error {
+		if trees[h] {
+			return nil
+		}
+		trees[h] = true
+
+		tree, err := repo.TreeObject(h)
+		if err == plumbing.ErrObjectNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range tree.Entries {
+			p := path.Join(dir, entry.Name)
+			switch entry.Mode {
+			case filemode.Dir:
+				if err := walk(entry.Hash, p); err != nil {
+					return err
+				}
+			case filemode.Submodule:
+			default:
+				if blobs[entry.Hash] {
+					continue
+				}
+				blobs[entry.Hash] = true
+				if _, ok := chains[p]; !ok {
+					paths = append(paths, p)
+				}
+				chains[p] = append(chains[p], entry.Hash)
+			}
+		}
+		return nil
+	}
+
+	for _, c := range commits {
+		if err := walk(c.TreeHash, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([][]plumbing.Hash, len(paths))
+	for i, p := range paths {
+		result[i] = chains[p]
+	}
+	return result, nil
+}
+
+// reachableCommits returns every commit reachable from a branch, tag or
+// reflog entry, history is allowed to be shallow
+func reachableCommits(repo *git.Repository) ([]*object.Commit, error) {
+	pending, err := rootObjects(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	shallow, err := shallowCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []*object.Commit
+	seen := make(map[plumbing.Hash]bool)
+	for len(pending) > 0 {
+		h := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			commits = append(commits, c)
+			if !shallow[h] {
+				pending = append(pending, c.ParentHashes...)
+			}
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(repo.Storer, obj)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, t.Target)
+		}
+	}
+
+	return commits, nil
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// RestorePath commits a file or directory of a branch back to its content at
+// an earlier revision, files that did not exist then are deleted. An empty
+// path restores the whole tree. Returns the hash of the new commit, or of the
+// branch head if the path already matches.
+func RestorePath(
+	db *proxy.DB,
+	name string,
+	branch string,
+	path string,
+	rev string,
+	author string,
+	message string,
+	email string) (string, error) {
+
+	path = strings.Trim(path, "/")
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	from, hash, err := resolveTreeFromName(repo, rev)
+	if err != nil {
+		return "", err
+	}
+
+	if len(message) == 0 {
+		message = fmt.Sprintf("Restore %s from %s", displayPath(path), hash)
+	}
+
+	_, c, err := commitPathFrom(repo, branch, from, path, "restore", message, author, email)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Hash.String(), nil
+}
+
+// commitPathFrom commits the entry of a path in a tree to the same path of a
+// branch, deleting the path if the tree does not have it. Returns the previous
+// head of the branch and the new commit, which is the head if nothing
+// changed.
+func commitPathFrom(
+	repo *git.Repository,
+	branch string,
+	from *object.Tree,
+	path string,
+	operation string,
+	message string,
+	author string,
+	email string) (*object.Commit, *object.Commit, error) {
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if head == nil {
+		return nil, nil, &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	tree, err := head.Tree()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry, current, err := pathEntries(from, tree, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sameEntry(entry, current) {
+		return head, head, nil
+	}
+
+	c, err := commitHeadChanges(repo, branch, head, operation, treeChanges{path: entry}, message, author, email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return head, c, nil
+}
+
+// pathEntries finds the entry of a path in two trees, the root directory for
+// an empty path
+func pathEntries(from *object.Tree, to *object.Tree, path string) (*object.TreeEntry, *object.TreeEntry, error) {
+	if len(path) == 0 {
+		return &object.TreeEntry{Mode: filemode.Dir, Hash: from.Hash},
+			&object.TreeEntry{Mode: filemode.Dir, Hash: to.Hash}, nil
+	}
+
+	a, err := treeEntry(from, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := treeEntry(to, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return a, b, nil
+}
+
+// displayPath names a path in messages, the root is shown as /
+func displayPath(path string) string {
+	if len(path) == 0 {
+		return "/"
+	}
+	return path
+}
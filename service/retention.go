@@ -0,0 +1,290 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// historyGrace is the grace period used to delete the objects of pruned
+// history, the same as the default of garbage collection
+const historyGrace = "1 day"
+
+// PruneHistoryResult summarises the effect of PruneHistory
+type PruneHistoryResult struct {
+	// Retained is the number of commits kept
+	Retained int `json:"retained"`
+	// Shallow is the number of kept commits whose parents were removed
+	Shallow int `json:"shallow"`
+	// Reflog is the number of reflog entries removed
+	Reflog int `json:"reflog"`
+	// Deleted is the number of objects deleted
+	Deleted int `json:"deleted"`
+	// Bytes is the storage reclaimed by the deleted objects
+	Bytes int64 `json:"bytes"`
+	// Pending is the number of unreachable objects kept for the grace period
+	Pending int `json:"pending"`
+}
+
+// SetRetention sets how much history PruneHistory keeps for a repository.
+// keepFor is a Postgres interval such as '2 years' and keepCommits a number
+// of commits per branch, an empty interval or zero commits means no limit.
+func SetRetention(db *proxy.DB, name string, keepFor string, keepCommits int64) error {
+	if keepCommits < 0 {
+		return &Error{"the number of commits to keep cannot be negative", InvalidArgument}
+	}
+
+	row, err := db.QueryRow(
+		`WITH updated AS (UPDATE repository SET retain_for = NULLIF($2, '')::interval, retain_commits = NULLIF($3, 0) WHERE name = $1 RETURNING 1) SELECT count(*) FROM updated`,
+		[]string{"text", "text", "bigint"},
+		name,
+		keepFor,
+		keepCommits)
+
+	if err != nil {
+		return err
+	}
+
+	var updated int
+	err = row.Scan(&updated)
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errDoesNotExist
+	}
+	return nil
+}
+
+// PruneHistory enforces the retention policy of a repository. Each branch
+// keeps the commits that are newer than the retention interval or among its
+// latest retained commits, the head of a branch and the commit of every tag
+// are always kept. Kept commits whose parents are not kept become shallow,
+// reflog entries that lead to removed commits are deleted and the objects
+// only the removed history used are garbage collected. The log, diffs and
+// archives stop at the shallow commits.
+func PruneHistory(db *proxy.DB, name string) (*PruneHistoryResult, error) {
+	// the extension only scans a bigint into an int64, retain_commits is an
+	// integer column
+	row, err := db.QueryRow(
+		`SELECT coalesce(extract(epoch FROM now() - retain_for)::bigint, 0), coalesce(retain_commits, 0)::bigint FROM repository WHERE name = $1`,
+		[]string{"text"},
+		name)
+
+	if err != nil {
+		return nil, errDoesNotExist
+	}
+
+	var cutoff, keepCommits int64
+	err = row.Scan(&cutoff, &keepCommits)
+	if err != nil {
+		return nil, err
+	}
+
+	if cutoff == 0 && keepCommits == 0 {
+		return nil, &Error{fmt.Sprintf("no history retention is set for %s", name), InvalidArgument}
+	}
+
+	var since time.Time
+	if cutoff != 0 {
+		since = time.Unix(cutoff, 0)
+	}
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := shallowParents(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	retained := make(map[plumbing.Hash]*object.Commit)
+	var targets []plumbing.Hash
+
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		targets = append(targets, ref.Hash())
+
+		if ref.Name().IsBranch() {
+			return retainBranch(repo, ref.Hash(), ignore, since, keepCommits, retained)
+		}
+
+		c, err := peelCommit(repo, ref.Hash())
+		if err != nil || c == nil {
+			return err
+		}
+		retained[c.Hash] = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var shallow []plumbing.Hash
+	keep := targets
+	for h, c := range retained {
+		keep = append(keep, h)
+		for _, p := range c.ParentHashes {
+			if retained[p] == nil {
+				shallow = append(shallow, h)
+				break
+			}
+		}
+	}
+	sort.Slice(shallow, func(i, j int) bool {
+		return shallow[i].String() < shallow[j].String()
+	})
+
+	s := repo.Storer.(*sqlstore.Storage)
+	err = s.SetShallow(shallow)
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := s.PruneReflog(keep)
+	if err != nil {
+		return nil, err
+	}
+
+	gc, err := collectGarbage(repo, historyGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PruneHistoryResult{
+		Retained: len(retained),
+		Shallow:  len(shallow),
+		Reflog:   removed,
+		Deleted:  gc.Deleted,
+		Bytes:    gc.Bytes,
+		Pending:  gc.Pending,
+	}, nil
+}
+
+// retainBranch adds the commits of a branch that the retention policy keeps,
+// newest first, stopping at the first commit that is neither recent enough
+// nor among the latest keepCommits
+func retainBranch(
+	repo *git.Repository,
+	head plumbing.Hash,
+	ignore []plumbing.Hash,
+	since time.Time,
+	keepCommits int64,
+	retained map[plumbing.Hash]*object.Commit) error {
+
+	commit, err := repo.CommitObject(head)
+	if err != nil {
+		return err
+	}
+
+	var n int64
+	commits := object.NewCommitIterCTime(commit, nil, ignore)
+	return commits.ForEach(func(c *object.Commit) error {
+		recent := !since.IsZero() && !c.Committer.When.Before(since)
+		if n > 0 && n >= keepCommits && !recent {
+			return storer.ErrStop
+		}
+
+		retained[c.Hash] = c
+		n++
+		return nil
+	})
+}
+
+// peelCommit returns the commit an object leads to through annotated tags,
+// or nil if it does not lead to a commit
+func peelCommit(repo *git.Repository, h plumbing.Hash) (*object.Commit, error) {
+	obj, err := repo.Storer.EncodedObject(plumbing.AnyObject, h)
+	if err == plumbing.ErrObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch obj.Type() {
+	case plumbing.CommitObject:
+		return object.DecodeCommit(repo.Storer, obj)
+	case plumbing.TagObject:
+		t, err := object.DecodeTag(repo.Storer, obj)
+		if err != nil {
+			return nil, err
+		}
+		return peelCommit(repo, t.Target)
+	default:
+		return nil, nil
+	}
+}
+
+// shallowCommits returns the commits whose parents have been removed from the
+// repository
+func shallowCommits(repo *git.Repository) (map[plumbing.Hash]bool, error) {
+	hashes, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	shallow := make(map[plumbing.Hash]bool, len(hashes))
+	for _, h := range hashes {
+		shallow[h] = true
+	}
+	return shallow, nil
+}
+
+// shallowParents lists the parents of the shallow commits, history walks pass
+// them as commits to ignore so that they stop at the shallow boundary
+func shallowParents(repo *git.Repository) ([]plumbing.Hash, error) {
+	hashes, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	var parents []plumbing.Hash
+	for _, h := range hashes {
+		c, err := repo.CommitObject(h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, c.ParentHashes...)
+	}
+	return parents, nil
+}
+
+// historyIter walks the history of a commit newest first, stopping at shallow
+// commits
+func historyIter(repo *git.Repository, from plumbing.Hash, byTime bool) (object.CommitIter, error) {
+	commit, err := repo.CommitObject(from)
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := shallowParents(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if byTime {
+		return object.NewCommitIterCTime(commit, nil, ignore), nil
+	}
+	return object.NewCommitPreorderIter(commit, nil, ignore), nil
+}
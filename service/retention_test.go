@@ -0,0 +1,45 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestPruneHistoryExtension calls prune_history through SQL, so the values it
+// reads are scanned with the column types Postgres returns to the extension
+// rather than converted by database/sql
+func TestPruneHistoryExtension(t *testing.T) {
+	db := extensionDB(t)
+	name := fmt.Sprintf("prune_history_%d", time.Now().UnixNano())
+
+	if _, err := db.Exec("SELECT create_repository($1)", name); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("SELECT delete_repository($1)", name)
+
+	for i := 0; i < 3; i++ {
+		_, err := db.Exec("SELECT commit_file($1, 'app.json', $2, 'test', 'update', 'test@example.com')", name, fmt.Sprintf(`{"version": %d}`, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := db.Exec("SELECT set_retention($1, '', 1)", name); err != nil {
+		t.Fatal(err)
+	}
+
+	var data string
+	if err := db.QueryRow("SELECT prune_history($1)", name).Scan(&data); err != nil {
+		t.Fatal(err)
+	}
+
+	var result PruneHistoryResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Retained != 1 || result.Shallow != 1 {
+		t.Errorf("retained %d commits with %d shallow, want 1 and 1", result.Retained, result.Shallow)
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// RevertCommit commits the inverse of the changes a commit made to its first
+// parent on top of a branch. If a later commit on the branch changed one of
+// the same files the files are reported as a conflict and nothing is
+// committed. Returns the hash of the new commit.
+func RevertCommit(
+	db *proxy.DB,
+	name string,
+	branch string,
+	rev string,
+	author string,
+	email string) (string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := resolveHashFromName(repo, rev)
+	if err != nil {
+		return "", err
+	}
+
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return "", errInvalidReference
+		}
+		return "", err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	changes, err := commitFileChanges(commit)
+	if err != nil {
+		return "", err
+	}
+
+	for i, c := range changes {
+		changes[i] = c.inverse()
+	}
+
+	tree, err := head.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	patch, conflicts, err := patchTree(tree, changes)
+	if err != nil {
+		return "", err
+	}
+	if len(conflicts) > 0 {
+		return "", conflictError(fmt.Sprintf("revert %s", hash), conflicts)
+	}
+	if len(patch) == 0 {
+		return "", &Error{fmt.Sprintf("the changes of %s are already reverted on %s", hash, branch), Conflict}
+	}
+
+	message := fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.\n", subject(commit.Message), hash)
+	c, err := commitHeadChanges(repo, branch, head, "revert", patch, message, author, email)
+	if err != nil {
+		return "", err
+	}
+
+	return c.Hash.String(), nil
+}
@@ -1,8 +1,8 @@
 package service
 
 import (
-	"archive/tar"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"regexp"
@@ -217,7 +217,7 @@ func GetRepositories(db *proxy.DB) ([]*Repository, error) {
 	repos := []*Repository{}
 	for rows.Next() {
 		repo := &Repository{}
-		err := rows.Scan([]interface{}{&repo.Name})
+		err := rows.Scan(&repo.Name)
 		if err != nil {
 			return nil, err
 		}
@@ -273,7 +273,7 @@ func GetFile(
 
 	return &FileInfo{
 		Contents: contents,
-		//RepoHash: ref.Hash().String(),
+		RepoHash: c.Hash.String(),
 		ItemHash: obj.Hash.String(),
 	}, nil
 }
@@ -374,85 +374,10 @@ func GetFiles(
 	path string,
 	matchHash string) (*FilesTar, error) {
 
-	rootPath := strings.TrimSuffix(strings.TrimSuffix(path, "*"), "/")
-
-	repo, err := openRepo(db, false, name)
-	if err != nil {
-		return nil, err
-	}
-
-	tree, rh, err := resolveTreeFromName(repo, branch)
-	if err != nil {
-		return nil, err
-	}
-
-	repoHash := rh.String()
-
-	if len(matchHash) > 0 && repoHash == matchHash {
-		return &FilesTar{
-			RepoHash:    repoHash,
-			NotModified: true,
-		}, nil
-	}
-
-	if len(rootPath) > 0 {
-		tree, err = tree.Tree(rootPath)
-		if err != nil {
-			if err == object.ErrDirectoryNotFound {
-				return &FilesTar{
-					RepoHash: repoHash,
-				}, nil
-			}
-			return nil, err
-		}
-	}
-
-	var buf bytes.Buffer
-	var itemHashes []string
-	result := tar.NewWriter(&buf)
-	fileIter := tree.Files()
-	defer fileIter.Close()
-	err = fileIter.ForEach(func(f *object.File) error {
-
-		contents, err := f.Contents()
-		if err != nil {
-			return err
-		}
-
-		hdr := &tar.Header{
-			Name: f.Name,
-			Mode: 0600,
-			Size: f.Size,
-		}
-		err = result.WriteHeader(hdr)
-		if err != nil {
-			return err
-		}
-
-		itemHashes = append(itemHashes, f.Hash.String())
-
-		if _, err := result.Write([]byte(contents)); err != nil {
-			return err
-		}
-
-		return nil
+	return GetArchive(db, name, branch, path, &ArchiveOptions{
+		Format:    ArchiveTar,
+		MatchHash: matchHash,
 	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = result.Close()
-	if err != nil {
-		return nil, err
-	}
-
-	return &FilesTar{
-		File:        &buf,
-		RepoHash:    repoHash,
-		ItemHashes:  itemHashes,
-		NotModified: false,
-	}, nil
 }
 
 // UpdateFile commits the specified file back to the specified repository
@@ -470,63 +395,46 @@ func UpdateFile(
 
 	path = strings.TrimPrefix(path, "/")
 
-	repo, err := openRepo(db, true, name)
-
-	if err != nil {
-		return nil, err
-	}
-
-	err = compareHash(repo, path, itemHash, repoHash)
-	if err != nil {
-		return nil, err
-	}
-
-	w, err := repo.Worktree()
-
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := w.Filesystem.Open(path)
-	if err != nil {
-		f, err = w.Filesystem.Create(path)
-		if err != nil {
-			return nil, err
-		}
-	}
+	repo, err := openRepo(db, false, name)
 
-	_, err = f.Write([]byte(content))
 	if err != nil {
 		return nil, err
 	}
 
-	err = f.Close()
+	head, err := branchHead(repo, branch)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = w.Add(path)
+	err = compareHash(head, path, itemHash, repoHash)
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := commitChanges(repo, w, message, author, email)
+	blob, err := writeBlob(repo.Storer, []byte(content))
 	if err != nil {
 		return nil, err
 	}
 
-	// get the file
-	obj, err := c.File(path)
+	c, err := commitHeadChanges(repo, branch, head, "commit", treeChanges{
+		path: {Mode: filemode.Regular, Hash: blob},
+	}, message, author, email)
 	if err != nil {
 		return nil, err
 	}
 
 	return &FileInfo{
 		RepoHash: c.Hash.String(),
-		ItemHash: obj.Hash.String(),
+		ItemHash: blob.String(),
 	}, nil
 }
 
+// FileUpdate is a file to write within a multi-file commit
+type FileUpdate struct {
+	Path    string
+	Content []byte
+}
+
 // DeleteFile removes the file specified from the specified repository
 func DeleteFile(
 	db *proxy.DB,
@@ -541,28 +449,35 @@ func DeleteFile(
 
 	path = strings.TrimPrefix(path, "/")
 
-	repo, err := openRepo(db, true, name)
+	repo, err := openRepo(db, false, name)
 
 	if err != nil {
 		return nil, err
 	}
 
-	err = compareHash(repo, path, itemHash, repoHash)
+	head, err := branchHead(repo, branch)
 	if err != nil {
 		return nil, err
 	}
 
-	w, err := repo.Worktree()
+	err = compareHash(head, path, itemHash, repoHash)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = w.Remove(path)
+	if head == nil {
+		return nil, errFileDoesNotExist
+	}
+
+	_, err = head.File(path)
 	if err != nil {
+		if err == object.ErrFileNotFound {
+			return nil, errFileDoesNotExist
+		}
 		return nil, err
 	}
 
-	c, err := commitChanges(repo, w, message, author, email)
+	c, err := commitHeadChanges(repo, branch, head, "commit", treeChanges{path: nil}, message, author, email)
 	if err != nil {
 		return nil, err
 	}
@@ -589,22 +504,164 @@ func CreateBranch(
 		return err
 	}
 
-	ref := plumbing.NewHashReference(refName(newBranch), hash)
-	return repo.Storer.SetReference(ref)
+	setReflog(repo, "branch", "", "", fmt.Sprintf("created from %s", sourceBranch))
+	return updateReference(repo, refName(newBranch), plumbing.ZeroHash, hash)
 }
 
-// DeleteBranch creates a branch based on the specified existing branch
+// ResetBranch moves an existing branch to any commit, tag or revision
+// expression. When expectedHash is given the branch is only moved if its head
+// is still that commit, otherwise a Conflict error is returned. The previous
+// head is recorded in the reflog. Returns the new head of the branch.
+func ResetBranch(
+	db *proxy.DB,
+	name string,
+	branch string,
+	rev string,
+	expectedHash string) (string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := branchHead(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	if head == nil {
+		return "", &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+
+	if len(expectedHash) > 0 && !strings.EqualFold(expectedHash, head.Hash.String()) {
+		return "", &Error{fmt.Sprintf("branch %s is at %s, expected %s", branch, head.Hash, expectedHash), Conflict}
+	}
+
+	target, err := resolveCommit(repo, rev)
+	if err != nil {
+		return "", err
+	}
+
+	if target.Hash == head.Hash {
+		return head.Hash.String(), nil
+	}
+
+	setReflog(repo, "reset", "", "", fmt.Sprintf("reset to %s", rev))
+	err = updateReference(repo, refName(branch), head.Hash, target.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	return target.Hash.String(), nil
+}
+
+// DeleteBranch removes a branch, the reflog records who deleted it and where
+// it pointed so that it can be restored
 func DeleteBranch(
 	db *proxy.DB,
 	name string,
-	branch string) error {
+	branch string,
+	author string,
+	email string) error {
 
-	s, err := sqlstore.NewStorage(db, name)
+	repo, err := openRepo(db, false, name)
 	if err != nil {
-		return errDoesNotExist
+		return err
 	}
 
-	return s.RemoveReference(refName(branch))
+	setReflog(repo, "delete", author, email, fmt.Sprintf("deleted %s", branch))
+	err = repo.Storer.RemoveReference(refName(branch))
+	if err == plumbing.ErrReferenceNotFound {
+		return &Error{fmt.Sprintf("branch %s doesn't exist", branch), NotFound}
+	}
+	return err
+}
+
+// CreateTag tags the specified revision, an annotated tag is created when a
+// message is provided
+func CreateTag(
+	db *proxy.DB,
+	name string,
+	tag string,
+	rev string,
+	message string,
+	author string,
+	email string) (string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := resolveHashFromName(repo, rev)
+	if err != nil {
+		return "", err
+	}
+
+	setReflog(repo, "tag", author, email, message)
+
+	target := hash
+	if len(message) > 0 {
+		target, err = writeTag(repo.Storer, &object.Tag{
+			Name:       tag,
+			Tagger:     newSignature(author, email),
+			Message:    strings.TrimSpace(message) + "\n",
+			TargetType: plumbing.CommitObject,
+			Target:     hash,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = updateReference(repo, plumbing.NewTagReferenceName(tag), plumbing.ZeroHash, target)
+	if err != nil {
+		return "", err
+	}
+
+	return target.String(), nil
+}
+
+// DeleteTag removes an existing tag
+func DeleteTag(
+	db *proxy.DB,
+	name string,
+	tag string) error {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return err
+	}
+
+	err = repo.DeleteTag(tag)
+	if err == git.ErrTagNotFound {
+		return &Error{fmt.Sprintf("tag %s doesn't exist", tag), NotFound}
+	}
+	return err
+}
+
+// GetTags lists the tags of a repository
+func GetTags(
+	db *proxy.DB,
+	name string) ([]string, error) {
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	defer tags.Close()
+
+	var result []string
+	err = tags.ForEach(func(t *plumbing.Reference) error {
+		result = append(result, t.Name().Short())
+		return nil
+	})
+
+	return result, err
 }
 
 // DiffFile returns a diff between the requested versions
@@ -635,13 +692,14 @@ func DiffFile(
 		return "", errInvalidReference
 	}
 
-	changes, err := fromTree.Diff(toTree)
+	changes, err := object.DiffTreeWithOptions(context.Background(), fromTree, toTree, object.DefaultDiffTreeOptions)
 	if err != nil {
 		return "", err
 	}
 
+	// a renamed file is matched by either its old or its new path
 	for _, c := range changes {
-		if c.To.Name == path {
+		if c.To.Name == path || c.From.Name == path {
 			patch, err := c.Patch()
 			if err != nil {
 				return "", err
@@ -664,7 +722,7 @@ func GetHistory(
 	since *time.Time,
 	until *time.Time,
 	file *string) ([]string, error) {
-	repo, err := openRepo(db, true, name)
+	repo, err := openRepo(db, false, name)
 	if err != nil {
 		return nil, err
 	}
@@ -674,23 +732,24 @@ func GetHistory(
 		return nil, err
 	}
 
-	var options = git.LogOptions{
-		From: hash,
+	entries, err := historyIter(repo, hash, false)
+	if err != nil {
+		return nil, err
 	}
 
+	if file != nil && len(*file) > 0 {
+		entries = newFollowIter(repo, entries, *file)
+	}
+
+	var limit object.LogLimitOptions
 	if since != nil && !since.IsZero() {
-		options.Since = since
+		limit.Since = since
 	}
 	if until != nil && !until.IsZero() {
-		options.Until = until
+		limit.Until = until
 	}
-	if file != nil && len(*file) > 0 {
-		options.FileName = file
-	}
-
-	entries, err := repo.Log(&options)
-	if err != nil {
-		return nil, err
+	if limit.Since != nil || limit.Until != nil {
+		entries = object.NewCommitLimitIterFromIter(entries, limit)
 	}
 	defer entries.Close()
 
@@ -740,7 +799,24 @@ func refName(n string) plumbing.ReferenceName {
 	return plumbing.ReferenceName(fmt.Sprintf("refs/heads/%s", n))
 }
 
-// resolve the name provided to a hash
+// ResolveRevision resolves a branch, tag, commit hash or revision expression
+// to a commit hash
+func ResolveRevision(db *proxy.DB, name string, rev string) (string, error) {
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := resolveHashFromName(repo, rev)
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+// resolve the name provided to a hash, branch names take precedence over
+// tags, commit hashes and revision expressions such as master~2
 func resolveHashFromName(repo *git.Repository, name string) (plumbing.Hash, error) {
 	if len(name) == 0 {
 		// default is HEAD
@@ -751,39 +827,21 @@ func resolveHashFromName(repo *git.Repository, name string) (plumbing.Hash, erro
 		return head.Hash(), nil
 	}
 
-	// Check if this is a reference
+	// Check if this is a branch
 	ref, err := repo.Reference(refName(name), true)
-	if err == nil && ref.Type() == plumbing.HashReference {
+	if err == nil {
 		return ref.Hash(), nil
 	}
-	if err != nil {
+	if err != plumbing.ErrReferenceNotFound {
 		return plumbing.ZeroHash, err
 	}
 
-	// check for a branch
-	branch, err := repo.Branch(name)
-	if err != nil && err != git.ErrBranchNotFound {
-		// branch not found is ok, error for anything else
-		return plumbing.ZeroHash, err
-	}
-	if err == nil {
-		// return the branch
-		reference, err := repo.Reference(branch.Merge, true)
-		if err == nil && reference.Type() == plumbing.HashReference {
-			return reference.Hash(), nil
-		}
-		return plumbing.NewHash(name), nil
-	}
-
-	// check for a tag
-	tag, err := repo.Tag(name)
-	if err == nil {
-		return tag.Hash(), nil
+	hash, err := repo.ResolveRevision(plumbing.Revision(name))
+	if err != nil {
+		return plumbing.ZeroHash, errInvalidReference
 	}
 
-	fmt.Printf("NOT FOUND -- %s", name)
-
-	return plumbing.NewHash(name), nil
+	return *hash, nil
 }
 
 func resolveTreeFromName(repo *git.Repository, name string) (*object.Tree, plumbing.Hash, error) {
@@ -806,24 +864,15 @@ func resolveTreeFromName(repo *git.Repository, name string) (*object.Tree, plumb
 	return tree, commit.Hash, nil
 }
 
-// compareHash compares the given repository to the provided hashes, if hashes
-// were provided and they do not match either the repository or the file (item)
-// an error will be returned.
-func compareHash(repo *git.Repository, path string, itemHash string, repoHash string) error {
+// compareHash compares the head of a branch, nil if it does not exist, to the
+// provided hashes, if hashes were provided and they do not match either the
+// head or the file (item) an error will be returned. The caller commits onto
+// the same head so that the compare-and-swap of the branch fails if it moved.
+func compareHash(c *object.Commit, path string, itemHash string, repoHash string) error {
 
 	if len(itemHash) > 0 || len(repoHash) > 0 {
-		head, err := repo.Head()
-		if err != nil {
-			return err
-		}
-
-		ref, err := repo.Reference(head.Name(), true)
-		if err != nil {
-			return err
-		}
-		c, err := repo.CommitObject(ref.Hash())
-		if err != nil {
-			return err
+		if c == nil {
+			return errHashConflict
 		}
 
 		if len(repoHash) > 0 && c.Hash.String() != repoHash {
@@ -834,6 +883,9 @@ func compareHash(repo *git.Repository, path string, itemHash string, repoHash st
 
 			f, err := c.File(path)
 			if err != nil {
+				if err == object.ErrFileNotFound {
+					return errHashConflict
+				}
 				return err
 			}
 
@@ -846,41 +898,6 @@ func compareHash(repo *git.Repository, path string, itemHash string, repoHash st
 	return nil
 }
 
-func commitChanges(
-	repo *git.Repository,
-	w *git.Worktree,
-	message string,
-	author string,
-	email string) (*object.Commit, error) {
-
-	h, err := w.Commit(message, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  author,
-			Email: email,
-			When:  time.Now(),
-		},
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	master := plumbing.NewHashReference(plumbing.Master, h)
-	err = repo.Storer.SetReference(master)
-
-	if err != nil {
-		return nil, err
-	}
-
-	c, err := repo.CommitObject(h)
-
-	if err != nil {
-		return nil, err
-	}
-
-	return c, nil
-}
-
 func openRepo(store *proxy.DB, filesystem bool, repository string) (*git.Repository, error) {
 	s, err := sqlstore.NewStorage(store, repository)
 
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// extensionDB connects to a database with the konfigraf extension installed,
+// given as a connection string in KONFIGRAF_TEST_DB, and skips the test when
+// there is none
+func extensionDB(t *testing.T) *sql.DB {
+	conn := os.Getenv("KONFIGRAF_TEST_DB")
+	if len(conn) == 0 {
+		t.Skip("KONFIGRAF_TEST_DB is not set")
+	}
+
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestResolveHashFromName(t *testing.T) {
+	s := memory.NewStorage()
+	repo, err := git.Init(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// master has three commits, the other references point at earlier ones
+	var commits []plumbing.Hash
+	var parents []plumbing.Hash
+	for i := 0; i < 3; i++ {
+		tree := buildTree(t, s, map[string]string{"a.json": fmt.Sprint(i)})
+		sig := newSignature("test", "test@example.com")
+		h, err := writeCommit(s, &object.Commit{
+			Author:       sig,
+			Committer:    sig,
+			Message:      fmt.Sprintf("commit %d", i),
+			TreeHash:     tree.Hash,
+			ParentHashes: parents,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, h)
+		parents = []plumbing.Hash{h}
+	}
+
+	tagger := newSignature("test", "test@example.com")
+	annotated := s.NewEncodedObject()
+	err = (&object.Tag{
+		Name:       "v0",
+		Tagger:     tagger,
+		Message:    "first",
+		TargetType: plumbing.CommitObject,
+		Target:     commits[0],
+	}).Encode(annotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := s.SetEncodedObject(annotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := map[plumbing.ReferenceName]plumbing.Hash{
+		"refs/heads/master": commits[2],
+		"refs/heads/dev":    commits[1],
+		"refs/heads/v1":     commits[0],
+		"refs/tags/v1":      commits[1],
+		"refs/tags/v2":      commits[2],
+		"refs/tags/v0":      tag,
+	}
+	for name, h := range refs {
+		if err := s.SetReference(plumbing.NewHashReference(name, h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		rev  string
+		// want is the index of the commit, -1 for an invalid reference
+		want int
+	}{
+		{"empty is the head", "", 2},
+		{"branch", "dev", 1},
+		{"branch over a tag of the same name", "v1", 0},
+		{"tag", "v2", 2},
+		{"annotated tag", "v0", 0},
+		{"full hash", commits[1].String(), 1},
+		{"short hash", commits[1].String()[:7], 1},
+		{"ancestor", "master~2", 0},
+		{"parent", "dev^", 0},
+		{"missing branch", "missing", -1},
+		{"beyond the first commit", "master~3", -1},
+		{"missing hash", plumbing.ComputeHash(plumbing.CommitObject, nil).String(), -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := resolveHashFromName(repo, test.rev)
+			if test.want < 0 {
+				if err != errInvalidReference {
+					t.Errorf("got %s, %v, want an invalid reference", h, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h != commits[test.want] {
+				t.Errorf("got %s, want commit %d", h, test.want)
+			}
+		})
+	}
+}
+
+// TestCommitBranchFileExtension commits through SQL to a branch other than
+// master, the commit is made on the tree of the branch and leaves master as
+// it was
+func TestCommitBranchFileExtension(t *testing.T) {
+	db := extensionDB(t)
+	name := fmt.Sprintf("commit_branch_file_%d", time.Now().UnixNano())
+
+	if _, err := db.Exec("SELECT create_repository($1)", name); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("SELECT delete_repository($1)", name)
+
+	var first []string
+	err := db.QueryRow("SELECT commit_file($1, 'a.json', '{}', 'test', 'add a', 'test@example.com')", name).Scan(pq.Array(&first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SELECT create_branch($1, 'master', 'dev')", name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SELECT commit_branch_file($1, 'dev', 'b.json', '{}', 'test', 'add b', 'test@example.com')", name); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]string{"master": {"a.json"}, "dev": {"a.json", "b.json"}}
+	for branch, want := range files {
+		var got []string
+		err := db.QueryRow("SELECT list_branch_files($1, $2, '')", name, branch).Scan(pq.Array(&got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has %v, want %v", branch, got, want)
+		}
+	}
+
+	var parent string
+	if err := db.QueryRow("SELECT resolve_revision($1, 'dev~1')", name).Scan(&parent); err != nil {
+		t.Fatal(err)
+	}
+	if parent != first[1] {
+		t.Errorf("dev~1 is %s, want %s", parent, first[1])
+	}
+
+	if _, err := db.Exec("SELECT resolve_revision($1, 'missing')", name); err == nil {
+		t.Error("resolved a missing branch")
+	}
+}
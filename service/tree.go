@@ -0,0 +1,314 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulhatch/konfigraf/sqlstore"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// treeChanges maps paths to the entry that should replace them, a nil entry
+// removes the path. Entries may be files or whole directories, a directory
+// entry for the empty path replaces the whole tree.
+type treeChanges map[string]*object.TreeEntry
+
+// applyTreeChanges writes a new tree based on the tree provided (nil for an
+// empty tree) with the changes applied and returns the hash of the new tree.
+// Only the trees along a changed path are written, all other entries keep
+// their existing hashes.
+func applyTreeChanges(s storer.EncodedObjectStorer, tree *object.Tree, changes treeChanges) (plumbing.Hash, error) {
+	h, _, err := writeTreeChanges(s, tree, changes)
+	return h, err
+}
+
+func writeTreeChanges(s storer.EncodedObjectStorer, tree *object.Tree, changes treeChanges) (plumbing.Hash, bool, error) {
+
+	if root, ok := changes[""]; ok {
+		tree = nil
+		if root != nil {
+			t, err := object.GetTree(s, root.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, false, err
+			}
+			tree = t
+		}
+	}
+
+	entries := make(map[string]object.TreeEntry)
+	if tree != nil {
+		for _, e := range tree.Entries {
+			entries[e.Name] = e
+		}
+	}
+
+	// changes at this level are applied first so that a directory can be
+	// replaced and then have changes applied inside of it
+	nested := make(map[string]treeChanges)
+	for path, entry := range changes {
+		path = strings.Trim(path, "/")
+		if len(path) == 0 {
+			continue
+		}
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			dir := path[:i]
+			if nested[dir] == nil {
+				nested[dir] = make(treeChanges)
+			}
+			nested[dir][path[i+1:]] = entry
+			continue
+		}
+
+		if entry == nil {
+			delete(entries, path)
+			continue
+		}
+
+		e := *entry
+		e.Name = path
+		entries[path] = e
+	}
+
+	for dir, c := range nested {
+		var subtree *object.Tree
+		if e, ok := entries[dir]; ok && e.Mode == filemode.Dir {
+			t, err := object.GetTree(s, e.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, false, err
+			}
+			subtree = t
+		}
+
+		h, empty, err := writeTreeChanges(s, subtree, c)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+
+		if empty {
+			delete(entries, dir)
+		} else {
+			entries[dir] = object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: h}
+		}
+	}
+
+	result := &object.Tree{}
+	for _, e := range entries {
+		result.Entries = append(result.Entries, e)
+	}
+	sortTreeEntries(result.Entries)
+
+	h, err := writeTree(s, result)
+	return h, len(result.Entries) == 0, err
+}
+
+// sortTreeEntries sorts entries in the order git expects, directories are
+// compared as if their name ended with a slash
+func sortTreeEntries(entries []object.TreeEntry) {
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+}
+
+func writeTree(s storer.EncodedObjectStorer, tree *object.Tree) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	err := tree.Encode(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+func writeBlob(s storer.EncodedObjectStorer, content []byte) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(content)))
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	_, err = w.Write(content)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return s.SetEncodedObject(obj)
+}
+
+func writeTag(s storer.EncodedObjectStorer, tag *object.Tag) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	err := tag.Encode(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+func writeCommit(s storer.EncodedObjectStorer, commit *object.Commit) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	err := commit.Encode(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// newSignature creates a signature for the current time
+func newSignature(author string, email string) object.Signature {
+	return object.Signature{
+		Name:  author,
+		Email: email,
+		When:  time.Now(),
+	}
+}
+
+// branchHead returns the commit at the head of a branch, or nil if the branch
+// does not exist yet as is the case with master in a new repository.
+func branchHead(repo *git.Repository, branch string) (*object.Commit, error) {
+	ref, err := repo.Reference(refName(branch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.CommitObject(ref.Hash())
+}
+
+// commitHeadChanges applies the changes to head, which must be the current
+// head of the branch or nil if it does not exist yet, and commits the
+// resulting tree to the branch. The operation is recorded in the reflog.
+func commitHeadChanges(
+	repo *git.Repository,
+	branch string,
+	head *object.Commit,
+	operation string,
+	changes treeChanges,
+	message string,
+	author string,
+	email string) (*object.Commit, error) {
+
+	var tree *object.Tree
+	var parents []plumbing.Hash
+	var err error
+	if head != nil {
+		tree, err = head.Tree()
+		if err != nil {
+			return nil, err
+		}
+		parents = []plumbing.Hash{head.Hash}
+	}
+
+	treeHash, err := applyTreeChanges(repo.Storer, tree, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	var headHash plumbing.Hash
+	if head != nil {
+		headHash = head.Hash
+	}
+
+	setReflog(repo, operation, author, email, message)
+
+	sig := newSignature(author, email)
+	return commitTree(repo, branch, headHash, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      message,
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	})
+}
+
+// commitTree writes the commit and moves the branch to it from head, which is
+// zero for a branch that does not exist yet
+func commitTree(
+	repo *git.Repository,
+	branch string,
+	head plumbing.Hash,
+	commit *object.Commit) (*object.Commit, error) {
+
+	h, err := writeCommit(repo.Storer, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	err = updateReference(repo, refName(branch), head, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.CommitObject(h)
+}
+
+// setReflog sets the reason recorded in the reflog for the reference changes
+// that follow, only the first line of the message is kept
+func setReflog(repo *git.Repository, operation string, author string, email string, message string) {
+	s, ok := repo.Storer.(*sqlstore.Storage)
+	if !ok {
+		return
+	}
+
+	who := author
+	if len(email) > 0 {
+		who = strings.TrimSpace(fmt.Sprintf("%s <%s>", author, email))
+	}
+
+	s.SetReflogInfo(sqlstore.ReflogInfo{Who: who, Operation: operation, Message: subject(message)})
+}
+
+// updateReference moves a reference from old to new, a zero old hash creates
+// the reference. If another transaction has changed the reference first a
+// Conflict error is returned and the reference is left as it is.
+func updateReference(repo *git.Repository, name plumbing.ReferenceName, old plumbing.Hash, new plumbing.Hash) error {
+	s, ok := repo.Storer.(*sqlstore.Storage)
+	if !ok {
+		return fmt.Errorf("unsupported storage %T", repo.Storer)
+	}
+
+	ref := plumbing.NewHashReference(name, new)
+
+	var err error
+	if old.IsZero() {
+		err = s.CreateReference(ref)
+	} else {
+		err = s.CheckAndSetReference(ref, plumbing.NewHashReference(name, old))
+	}
+
+	if err != sqlstore.ErrRefHasChanged {
+		return err
+	}
+
+	kind := "reference"
+	if name.IsBranch() {
+		kind = "branch"
+	} else if name.IsTag() {
+		kind = "tag"
+	}
+
+	if old.IsZero() {
+		return &Error{fmt.Sprintf("%s %s already exists", kind, name.Short()), Conflict}
+	}
+	return &Error{fmt.Sprintf("%s %s has been changed concurrently", kind, name.Short()), Conflict}
+}
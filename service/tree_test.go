@@ -0,0 +1,284 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+func TestWriteTreeChanges(t *testing.T) {
+	base := map[string]string{
+		"a.json":          "a",
+		"app/config.json": "config",
+		"app/sub/b.json":  "b",
+		"other/c.json":    "c",
+	}
+
+	tests := []struct {
+		name string
+		// write maps paths to new file contents
+		write map[string]string
+		// remove lists paths to delete
+		remove []string
+		// copy maps paths to the path of the base tree entry they are set to
+		copy  map[string]string
+		want  map[string]string
+		empty bool
+	}{
+		{
+			name: "no changes",
+			want: base,
+		},
+		{
+			name:  "add a file in a new directory",
+			write: map[string]string{"new/dir/d.json": "d"},
+			want: map[string]string{
+				"a.json":          "a",
+				"app/config.json": "config",
+				"app/sub/b.json":  "b",
+				"other/c.json":    "c",
+				"new/dir/d.json":  "d",
+			},
+		},
+		{
+			name:  "update a nested file",
+			write: map[string]string{"/app/sub/b.json/": "b2"},
+			want: map[string]string{
+				"a.json":          "a",
+				"app/config.json": "config",
+				"app/sub/b.json":  "b2",
+				"other/c.json":    "c",
+			},
+		},
+		{
+			name:   "deleting the last file removes the directory",
+			remove: []string{"app/sub/b.json", "other/c.json"},
+			want: map[string]string{
+				"a.json":          "a",
+				"app/config.json": "config",
+			},
+		},
+		{
+			name:   "delete a directory",
+			remove: []string{"app"},
+			want: map[string]string{
+				"a.json":       "a",
+				"other/c.json": "c",
+			},
+		},
+		{
+			name:   "delete a missing path",
+			remove: []string{"missing/x.json"},
+			want:   base,
+		},
+		{
+			name:   "move a directory",
+			remove: []string{"app"},
+			copy:   map[string]string{"moved/app": "app"},
+			want: map[string]string{
+				"a.json":                "a",
+				"moved/app/config.json": "config",
+				"moved/app/sub/b.json":  "b",
+				"other/c.json":          "c",
+			},
+		},
+		{
+			name:  "replace a directory and change a file inside it",
+			copy:  map[string]string{"app": "other"},
+			write: map[string]string{"app/e.json": "e"},
+			want: map[string]string{
+				"a.json":       "a",
+				"app/c.json":   "c",
+				"app/e.json":   "e",
+				"other/c.json": "c",
+			},
+		},
+		{
+			name:  "replace a file with a directory",
+			write: map[string]string{"a.json/x.json": "x"},
+			want: map[string]string{
+				"a.json/x.json":   "x",
+				"app/config.json": "config",
+				"app/sub/b.json":  "b",
+				"other/c.json":    "c",
+			},
+		},
+		{
+			name: "replace the whole tree",
+			copy: map[string]string{"": "app"},
+			want: map[string]string{
+				"config.json": "config",
+				"sub/b.json":  "b",
+			},
+		},
+		{
+			name:   "remove everything",
+			remove: []string{""},
+			want:   map[string]string{},
+			empty:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := memory.NewStorage()
+			tree := buildTree(t, s, base)
+
+			changes := make(treeChanges)
+			for p, source := range test.copy {
+				e, err := treeEntry(tree, source)
+				if err != nil || e == nil {
+					t.Fatalf("no entry for %s: %v", source, err)
+				}
+				changes[p] = e
+			}
+			for p, content := range test.write {
+				h, err := writeBlob(s, []byte(content))
+				if err != nil {
+					t.Fatal(err)
+				}
+				changes[p] = &object.TreeEntry{Mode: filemode.Regular, Hash: h}
+			}
+			for _, p := range test.remove {
+				changes[p] = nil
+			}
+
+			h, empty, err := writeTreeChanges(s, tree, changes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if empty != test.empty {
+				t.Errorf("empty = %v, want %v", empty, test.empty)
+			}
+
+			got := treeFiles(t, s, h)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+
+			// the same files written from scratch give the same tree
+			if want := buildTree(t, s, test.want); h != want.Hash {
+				t.Errorf("tree %s, want %s", h, want.Hash)
+			}
+		})
+	}
+}
+
+func TestSortTreeEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []object.TreeEntry
+		want    []string
+	}{
+		{
+			name: "files",
+			entries: []object.TreeEntry{
+				{Name: "b", Mode: filemode.Regular},
+				{Name: "a.json", Mode: filemode.Regular},
+				{Name: "a", Mode: filemode.Regular},
+			},
+			want: []string{"a", "a.json", "b"},
+		},
+		{
+			name: "directories sort as if they ended with a slash",
+			entries: []object.TreeEntry{
+				{Name: "a0", Mode: filemode.Regular},
+				{Name: "a", Mode: filemode.Dir},
+				{Name: "a.json", Mode: filemode.Regular},
+				{Name: "a-b", Mode: filemode.Regular},
+			},
+			want: []string{"a-b", "a.json", "a", "a0"},
+		},
+		{
+			name: "a directory after a file of a shorter name",
+			entries: []object.TreeEntry{
+				{Name: "ab", Mode: filemode.Dir},
+				{Name: "a", Mode: filemode.Regular},
+			},
+			want: []string{"a", "ab"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sortTreeEntries(test.entries)
+			got := make([]string, len(test.entries))
+			for i, e := range test.entries {
+				got[i] = e.Name
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// buildTree writes a tree holding the files given by path
+func buildTree(t *testing.T, s storer.EncodedObjectStorer, files map[string]string) *object.Tree {
+	changes := make(treeChanges)
+	for p, content := range files {
+		h, err := writeBlob(s, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes[p] = &object.TreeEntry{Mode: filemode.Regular, Hash: h}
+	}
+
+	h, err := applyTreeChanges(s, nil, changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := object.GetTree(s, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// treeFiles reads the content of every file in a tree by path
+func treeFiles(t *testing.T, s storer.EncodedObjectStorer, h plumbing.Hash) map[string]string {
+	tree, err := object.GetTree(s, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		content, err := f.Contents()
+		files[f.Name] = content
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSorted(t, s, tree)
+	return files
+}
+
+// checkSorted fails the test if the entries of a tree or any of its subtrees
+// are not in the order git expects
+func checkSorted(t *testing.T, s storer.EncodedObjectStorer, tree *object.Tree) {
+	sorted := append([]object.TreeEntry(nil), tree.Entries...)
+	sortTreeEntries(sorted)
+	if !reflect.DeepEqual(sorted, tree.Entries) {
+		t.Errorf("entries of %s are not sorted", tree.Hash)
+	}
+
+	for _, e := range tree.Entries {
+		if e.Mode != filemode.Dir {
+			continue
+		}
+		sub, err := object.GetTree(s, e.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSorted(t, s, sub)
+	}
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ValueChange is a commit that changed the value at a location of a JSON file
+type ValueChange struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+	// Old is the value before the commit, nil if it was missing
+	Old json.RawMessage `json:"old"`
+	// New is the value after the commit, nil if it was removed
+	New json.RawMessage `json:"new"`
+}
+
+// ValueHistory lists the commits of a branch that changed the value at a
+// pointer of a JSON file, newest first. The pointer is either a JSON path
+// such as $.database.pool.max or $.servers[0]['host name'], or a JSON pointer
+// such as /database/pool/max, an empty pointer or $ is the whole document.
+// Values are compared once parsed so reformatting a file is not a change. A
+// value is missing when the file, the key or the index does not exist or the
+// file is not valid JSON. A merge is only listed when the value differs from
+// every parent and the history stops at shallow commits.
+func ValueHistory(db *proxy.DB, name string, branch string, path string, pointer string) ([]*ValueChange, error) {
+	path = strings.Trim(path, "/")
+
+	keys, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := openRepo(db, false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := resolveHashFromName(repo, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err := historyIter(repo, hash, true)
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+
+	v := &valueReader{repo: repo, path: path, keys: keys, values: make(map[plumbing.Hash]json.RawMessage)}
+	changes := []*ValueChange{}
+
+	for {
+		c, err := commits.Next()
+		if err == io.EOF {
+			return changes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := v.commitValue(c.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		changed := true
+		var old json.RawMessage
+		for i, p := range c.ParentHashes {
+			parent, err := v.commitValue(p)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				old = parent
+			}
+			if bytes.Equal(parent, value) {
+				changed = false
+				break
+			}
+		}
+		if len(c.ParentHashes) == 0 {
+			changed = value != nil
+		}
+		if !changed {
+			continue
+		}
+
+		changes = append(changes, &ValueChange{
+			Hash:    c.Hash.String(),
+			Author:  c.Author.Name,
+			Email:   c.Author.Email,
+			Date:    c.Author.When,
+			Message: c.Message,
+			Old:     old,
+			New:     value,
+		})
+	}
+}
+
+// valueReader reads the value at a pointer of a file in commits, parsing each
+// version of the file only once
+type valueReader struct {
+	repo *git.Repository
+	path string
+	keys []string
+	// values holds the value of each version of the file by blob hash
+	values map[plumbing.Hash]json.RawMessage
+}
+
+// commitValue returns the value in a commit as compact JSON with sorted keys,
+// or nil if it is missing. A commit that is not in the repository, such as
+// the parent of a shallow commit, has no value.
+func (v *valueReader) commitValue(h plumbing.Hash) (json.RawMessage, error) {
+	c, err := v.repo.CommitObject(h)
+	if err == plumbing.ErrObjectNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := c.File(v.path)
+	if err == object.ErrFileNotFound || err == object.ErrDirectoryNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := v.values[f.Hash]; ok {
+		return value, nil
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var doc interface{}
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	var value json.RawMessage
+	if d.Decode(&doc) == nil {
+		if found, ok := lookupValue(doc, v.keys); ok {
+			value, err = json.Marshal(found)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	v.values[f.Hash] = value
+	return value, nil
+}
+
+// lookupValue follows keys through objects and arrays of a parsed document
+func lookupValue(doc interface{}, keys []string) (interface{}, bool) {
+	for _, k := range keys {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[k]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// parsePointer splits a JSON path or a JSON pointer into the keys it follows
+func parsePointer(pointer string) ([]string, error) {
+	switch {
+	case pointer == "" || pointer == "$":
+		return nil, nil
+	case strings.HasPrefix(pointer, "/"):
+		keys := strings.Split(pointer[1:], "/")
+		for i, k := range keys {
+			keys[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(k)
+		}
+		return keys, nil
+	case !strings.HasPrefix(pointer, "$"):
+		return nil, &Error{fmt.Sprintf("invalid pointer %s, expected a JSON path starting with $ or a JSON pointer starting with /", pointer), InvalidArgument}
+	}
+
+	invalid := &Error{fmt.Sprintf("invalid JSON path %s", pointer), InvalidArgument}
+	var keys []string
+	rest := pointer[1:]
+	for len(rest) > 0 {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, invalid
+			}
+			keys = append(keys, rest[1:end+1])
+			rest = rest[end+1:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, invalid
+			}
+			keys = append(keys, rest[2:end])
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, invalid
+			}
+			if _, err := strconv.Atoi(rest[1:end]); err != nil {
+				return nil, invalid
+			}
+			keys = append(keys, rest[1:end])
+			rest = rest[end+1:]
+		default:
+			return nil, invalid
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+		invalid bool
+	}{
+		{pointer: "", want: nil},
+		{pointer: "$", want: nil},
+		{pointer: "$.database", want: []string{"database"}},
+		{pointer: "$.database.pool.max", want: []string{"database", "pool", "max"}},
+		{pointer: "$.servers[0]", want: []string{"servers", "0"}},
+		{pointer: "$.servers[10].host", want: []string{"servers", "10", "host"}},
+		{pointer: "$['host name']", want: []string{"host name"}},
+		{pointer: "$.servers[0]['host.name']", want: []string{"servers", "0", "host.name"}},
+		{pointer: "$[1][2]", want: []string{"1", "2"}},
+		{pointer: "/database/pool/max", want: []string{"database", "pool", "max"}},
+		{pointer: "/servers/0", want: []string{"servers", "0"}},
+		{pointer: "/", want: []string{""}},
+		{pointer: "/a~1b/c~0d", want: []string{"a/b", "c~d"}},
+		{pointer: "/~01", want: []string{"~1"}},
+		{pointer: "database", invalid: true},
+		{pointer: "$database", invalid: true},
+		{pointer: "$.", invalid: true},
+		{pointer: "$..a", invalid: true},
+		{pointer: "$.a[", invalid: true},
+		{pointer: "$.a[x]", invalid: true},
+		{pointer: "$['a'", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pointer, func(t *testing.T) {
+			keys, err := parsePointer(test.pointer)
+			if test.invalid {
+				if e, ok := err.(*Error); !ok || e.Code != InvalidArgument {
+					t.Fatalf("got %v, %v, want an invalid argument error", keys, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Errorf("got %q, want %q", keys, test.want)
+			}
+		})
+	}
+}
+
+func TestLookupValue(t *testing.T) {
+	doc := `{
+		"database": {"pool": {"max": 10, "min": null}},
+		"servers": [{"host": "a"}, {"host": "b"}],
+		"": "empty key",
+		"a/b": true
+	}`
+
+	tests := []struct {
+		name    string
+		pointer string
+		// want is the value found as JSON, empty if it is missing
+		want string
+	}{
+		{"whole document", "$", `{"":"empty key","a/b":true,"database":{"pool":{"max":10,"min":null}},"servers":[{"host":"a"},{"host":"b"}]}`},
+		{"nested key", "$.database.pool.max", `10`},
+		{"null is a value", "/database/pool/min", `null`},
+		{"object", "$.database.pool", `{"max":10,"min":null}`},
+		{"array index", "$.servers[1].host", `"b"`},
+		{"array", "/servers", `[{"host":"a"},{"host":"b"}]`},
+		{"empty key", "/", `"empty key"`},
+		{"escaped key", "/a~1b", `true`},
+		{"missing key", "$.database.port", ""},
+		{"index out of range", "$.servers[2]", ""},
+		{"index of an object", "$.database[0]", ""},
+		{"key of an array", "$.servers.host", ""},
+		{"key of a number", "$.database.pool.max.value", ""},
+		{"key of null", "$.database.pool.min.value", ""},
+		{"negative index", "/servers/-1", ""},
+	}
+
+	d := json.NewDecoder(strings.NewReader(doc))
+	d.UseNumber()
+	var parsed interface{}
+	if err := d.Decode(&parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parsePointer(test.pointer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, ok := lookupValue(parsed, keys)
+			if len(test.want) == 0 {
+				if ok {
+					t.Errorf("found %v, want it missing", value)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("value is missing")
+			}
+
+			got, err := json.Marshal(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package sqlstore
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// objectCacheSize is the number of bytes of object content each backend keeps
+// in memory
+const objectCacheSize = 64 << 20
+
+// objectsCache caches decoded objects across every call made in a backend,
+// objects are addressed by their content so an entry never goes stale. They
+// are keyed by repository as well since an object only exists in the
+// repositories it was written to. Objects deleted by another backend are
+// dropped once the generation of their repository changes. Only objects read in transactions that have
+// not written anything are added, anything else may never be committed.
+var objectsCache = newObjectCache(objectCacheSize)
+
+// refsCache caches the references read in a backend for as long as the
+// snapshot and statement they were read in are current
+var refsCache = &refCache{repos: make(map[int]*cachedRefs)}
+
+type objectKey struct {
+	repositoryID int
+	hash         plumbing.Hash
+}
+
+type cachedObject struct {
+	key     objectKey
+	objType plumbing.ObjectType
+	content []byte
+}
+
+// objectCache is a least recently used cache limited by the total size of the
+// content it holds
+type objectCache struct {
+	mu      sync.Mutex
+	max     int
+	size    int
+	ll      *list.List
+	entries map[objectKey]*list.Element
+	// generations holds the generation of each repository the cached objects
+	// were read in
+	generations map[int]int64
+}
+
+func newObjectCache(max int) *objectCache {
+	return &objectCache{max: max, ll: list.New(), entries: make(map[objectKey]*list.Element), generations: make(map[int]int64)}
+}
+
+// validate drops the objects of a repository if they were read before objects
+// were deleted from it. Returns false if the generation is older than that of
+// the cached objects, a transaction with an older snapshot must not fill the
+// cache since it may still see deleted objects.
+func (c *objectCache) validate(repositoryID int, generation int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.generations[repositoryID]
+	switch {
+	case ok && generation < cached:
+		return false
+	case ok && generation == cached:
+		return true
+	}
+
+	c.removeLocked(repositoryID)
+	c.generations[repositoryID] = generation
+	return true
+}
+
+func (c *objectCache) get(repositoryID int, h plumbing.Hash) (*cachedObject, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[objectKey{repositoryID, h}]
+	if !ok {
+		return nil, false
+	}
+
+	c.ll.MoveToFront(e)
+	return e.Value.(*cachedObject), true
+}
+
+// put adds the content of an object, objects larger than the cache are not
+// kept
+func (c *objectCache) put(repositoryID int, h plumbing.Hash, t plumbing.ObjectType, content []byte) {
+	if len(content) > c.max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := objectKey{repositoryID, h}
+	if e, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&cachedObject{key, t, content})
+	c.size += len(content)
+
+	for c.size > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+// removeRepository drops the objects of a repository, used once objects have
+// been deleted from it
+func (c *objectCache) removeRepository(repositoryID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(repositoryID)
+	delete(c.generations, repositoryID)
+}
+
+func (c *objectCache) removeLocked(repositoryID int) {
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cachedObject).key.repositoryID == repositoryID {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+func (c *objectCache) remove(e *list.Element) {
+	o := c.ll.Remove(e).(*cachedObject)
+	delete(c.entries, o.key)
+	c.size -= len(o.content)
+}
+
+// refCache holds references by repository. References can change in any
+// transaction so the cache is only valid for the snapshot it was filled in,
+// it is emptied whenever a storage is opened in a different transaction or
+// statement or after other transactions have committed. It is only used by
+// transactions that have not written anything, since a write may be rolled
+// back to a savepoint without changing the snapshot.
+type refCache struct {
+	mu       sync.Mutex
+	snapshot string
+	repos    map[int]*cachedRefs
+	// generation counts the writes made in the backend, a storage stops using
+	// the caches once a write has been made after it was opened
+	generation int
+}
+
+type cachedRefs struct {
+	// refs maps names to references, a nil reference is known not to exist
+	refs map[plumbing.ReferenceName]*plumbing.Reference
+	// complete is set once every reference of the repository has been read
+	complete bool
+}
+
+// validate empties the cache if it was filled in another snapshot and
+// returns the generation a storage opened now may use the caches in
+func (c *refCache) validate(snapshot string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.snapshot != snapshot {
+		c.snapshot = snapshot
+		c.repos = make(map[int]*cachedRefs)
+	}
+	return c.generation
+}
+
+// invalidate empties the cache after a write and stops every open storage
+// from using the caches
+func (c *refCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.snapshot = ""
+	c.repos = make(map[int]*cachedRefs)
+	c.generation++
+}
+
+// current reports if no write has been made since a generation
+func (c *refCache) current(generation int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation == generation
+}
+
+func (c *refCache) repo(repositoryID int) *cachedRefs {
+	r, ok := c.repos[repositoryID]
+	if !ok {
+		r = &cachedRefs{refs: make(map[plumbing.ReferenceName]*plumbing.Reference)}
+		c.repos[repositoryID] = r
+	}
+	return r
+}
+
+// get returns a reference and whether it was found in the cache
+func (c *refCache) get(repositoryID int, n plumbing.ReferenceName) (*plumbing.Reference, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := c.repo(repositoryID)
+	ref, ok := r.refs[n]
+	if !ok && r.complete {
+		return nil, true
+	}
+	return ref, ok
+}
+
+// set records the current value of a reference, nil when it does not exist
+func (c *refCache) set(repositoryID int, n plumbing.ReferenceName, ref *plumbing.Reference) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.repo(repositoryID).refs[n] = ref
+}
+
+// all returns every reference of a repository sorted by name if they have all
+// been read
+func (c *refCache) all(repositoryID int) ([]*plumbing.Reference, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := c.repo(repositoryID)
+	if !r.complete {
+		return nil, false
+	}
+
+	var result []*plumbing.Reference
+	for _, ref := range r.refs {
+		if ref != nil {
+			result = append(result, ref)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, true
+}
+
+// setAll replaces the references of a repository with the complete list
+func (c *refCache) setAll(repositoryID int, all []*plumbing.Reference) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := &cachedRefs{refs: make(map[plumbing.ReferenceName]*plumbing.Reference), complete: true}
+	for _, ref := range all {
+		r.refs[ref.Name()] = ref
+	}
+	c.repos[repositoryID] = r
+}
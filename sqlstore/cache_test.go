@@ -0,0 +1,168 @@
+package sqlstore
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestObjectCache(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		// ops are run in order, each one of
+		//   put <repo> <name> <size>
+		//   get <repo> <name> <hit>
+		//   remove <repo>
+		//   validate <repo> <generation> <current>
+		ops []string
+		// want lists the objects left in the cache as <repo>/<name>
+		want []string
+	}{
+		{
+			name: "least recently put is evicted",
+			max:  10,
+			ops:  []string{"put 1 a 4", "put 1 b 4", "put 1 c 4"},
+			want: []string{"1/b", "1/c"},
+		},
+		{
+			name: "get makes an object recently used",
+			max:  10,
+			ops:  []string{"put 1 a 4", "put 1 b 4", "get 1 a true", "put 1 c 4"},
+			want: []string{"1/a", "1/c"},
+		},
+		{
+			name: "putting an object again makes it recently used",
+			max:  10,
+			ops:  []string{"put 1 a 4", "put 1 b 4", "put 1 a 4", "put 1 c 4"},
+			want: []string{"1/a", "1/c"},
+		},
+		{
+			name: "several objects are evicted for a large one",
+			max:  10,
+			ops:  []string{"put 1 a 3", "put 1 b 3", "put 1 c 3", "put 1 d 9"},
+			want: []string{"1/d"},
+		},
+		{
+			name: "an object the size of the cache is kept",
+			max:  10,
+			ops:  []string{"put 1 a 4", "put 1 b 10"},
+			want: []string{"1/b"},
+		},
+		{
+			name: "an object larger than the cache is not kept",
+			max:  10,
+			ops:  []string{"put 1 a 4", "put 1 b 11", "get 1 b false"},
+			want: []string{"1/a"},
+		},
+		{
+			name: "empty objects are kept",
+			max:  10,
+			ops:  []string{"put 1 a 10", "put 1 b 0", "get 1 b true"},
+			want: []string{"1/a", "1/b"},
+		},
+		{
+			name: "objects are kept by repository",
+			max:  10,
+			ops:  []string{"put 1 a 4", "get 2 a false", "put 2 a 4"},
+			want: []string{"1/a", "2/a"},
+		},
+		{
+			name: "remove drops the objects of a repository",
+			max:  10,
+			ops:  []string{"put 1 a 2", "put 2 b 2", "put 1 c 2", "remove 1", "get 1 a false", "put 2 d 6"},
+			want: []string{"2/b", "2/d"},
+		},
+		{
+			name: "a new generation drops the objects of a repository",
+			max:  10,
+			ops:  []string{"validate 1 0 true", "put 1 a 4", "put 2 b 4", "validate 1 0 true", "get 1 a true", "validate 1 1 true", "get 1 a false"},
+			want: []string{"2/b"},
+		},
+		{
+			name: "an older generation may not fill the cache",
+			max:  10,
+			ops:  []string{"validate 1 2 true", "put 1 a 4", "validate 1 1 false", "get 1 a true"},
+			want: []string{"1/a"},
+		},
+		{
+			name: "the generation is forgotten when a repository is removed",
+			max:  10,
+			ops:  []string{"validate 1 2 true", "remove 1", "validate 1 1 true"},
+			want: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newObjectCache(test.max)
+			size := map[objectKey]int{}
+
+			for _, op := range test.ops {
+				var kind string
+				var repo int
+				var name string
+				var n int
+				var ok bool
+
+				fmt.Sscan(op, &kind)
+				switch kind {
+				case "put":
+					fmt.Sscan(op, &kind, &repo, &name, &n)
+					key := objectKey{repo, plumbing.ComputeHash(plumbing.BlobObject, []byte(name))}
+					c.put(repo, key.hash, plumbing.BlobObject, make([]byte, n))
+					size[key] = n
+				case "get":
+					fmt.Sscan(op, &kind, &repo, &name, &ok)
+					_, hit := c.get(repo, plumbing.ComputeHash(plumbing.BlobObject, []byte(name)))
+					if hit != ok {
+						t.Errorf("%s: hit = %v", op, hit)
+					}
+				case "remove":
+					fmt.Sscan(op, &kind, &repo)
+					c.removeRepository(repo)
+				case "validate":
+					fmt.Sscan(op, &kind, &repo, &n, &ok)
+					if current := c.validate(repo, int64(n)); current != ok {
+						t.Errorf("%s: current = %v", op, current)
+					}
+				default:
+					t.Fatalf("unknown op %s", op)
+				}
+			}
+
+			names := map[plumbing.Hash]string{}
+			for _, op := range test.ops {
+				var kind, name string
+				var repo int
+				fmt.Sscan(op, &kind, &repo, &name)
+				names[plumbing.ComputeHash(plumbing.BlobObject, []byte(name))] = name
+			}
+
+			got := []string{}
+			total := 0
+			for e := c.ll.Front(); e != nil; e = e.Next() {
+				o := e.Value.(*cachedObject)
+				got = append(got, fmt.Sprintf("%d/%s", o.key.repositoryID, names[o.key.hash]))
+				total += size[o.key]
+				if c.entries[o.key] != e {
+					t.Errorf("%d/%s is not indexed", o.key.repositoryID, names[o.key.hash])
+				}
+			}
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+			if len(c.entries) != len(got) {
+				t.Errorf("%d entries for %d objects", len(c.entries), len(got))
+			}
+			if c.size != total {
+				t.Errorf("size %d, want %d", c.size, total)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package sqlstore
+
+import (
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// CopyObjects copies objects from another repository as they are stored,
+// without decoding or compressing them again. Objects stored as deltas bring
+// their bases along. Objects this repository already has keep their stored
+// form. Returns the number of objects copied.
+func (s *Storage) CopyObjects(from *Storage, objects []plumbing.Hash) (int, error) {
+	hashes := make([]string, len(objects))
+	for i, h := range objects {
+		hashes[i] = h.String()
+	}
+
+	s.write()
+	err := s.shareObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	row, err := s.db.QueryRow(
+		`WITH RECURSIVE copy(hash) AS (
+			SELECT decode(h, 'hex') FROM unnest($3::text[]) AS h
+			UNION
+			SELECT o.base FROM objects o JOIN copy c ON o.hash = c.hash
+			WHERE o.repo_id = $2 AND o.base IS NOT NULL
+		), copied AS (
+			INSERT INTO objects (repo_id, obj_type, hash, blob, format, base, size)
+			SELECT $1, obj_type, hash, blob, format, base, size FROM objects
+			WHERE repo_id = $2 AND hash IN (SELECT hash FROM copy)
+			ON CONFLICT DO NOTHING
+			RETURNING 1)
+		SELECT count(*) FROM copied`,
+		[]string{"integer", "integer", "text[]"},
+		s.repositoryID,
+		from.repositoryID,
+		hashes)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int
+	return copied, row.Scan(&copied)
+}
@@ -0,0 +1,101 @@
+package sqlstore
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+)
+
+// Storage formats of the blob column of the objects table, rows written
+// before compression was added have the raw format
+const (
+	formatRaw   = 0
+	formatZlib  = 1
+	formatDelta = 2
+)
+
+// storedObject is an object as it is written to the objects table
+type storedObject struct {
+	objType plumbing.ObjectType
+	hash    plumbing.Hash
+	format  int
+	// base is the object the delta applies to when the format is formatDelta
+	base plumbing.Hash
+	// size is the length of the decoded content
+	size int64
+	data []byte
+}
+
+// newStoredObject compresses the content of an object for storage
+func newStoredObject(t plumbing.ObjectType, h plumbing.Hash, content []byte) (*storedObject, error) {
+	data, err := compress(content)
+	if err != nil {
+		return nil, err
+	}
+	return &storedObject{objType: t, hash: h, format: formatZlib, size: int64(len(content)), data: data}, nil
+}
+
+// newDeltaObject stores the content as a compressed delta against the base.
+// Empty content is stored whole since a delta to nothing is too short for
+// packfile.PatchDelta to accept.
+func newDeltaObject(t plumbing.ObjectType, h plumbing.Hash, base plumbing.Hash, baseContent []byte, content []byte) (*storedObject, error) {
+	if len(content) == 0 {
+		return newStoredObject(t, h, content)
+	}
+
+	data, err := compress(packfile.DiffDelta(baseContent, content))
+	if err != nil {
+		return nil, err
+	}
+	return &storedObject{objType: t, hash: h, format: formatDelta, base: base, size: int64(len(content)), data: data}, nil
+}
+
+// decode returns the content of a stored object, deltas are resolved by
+// reading their base which may in turn be a delta
+func (s *Storage) decode(format int, base string, blob []byte) ([]byte, error) {
+	switch format {
+	case formatRaw:
+		return blob, nil
+	case formatZlib:
+		return decompress(blob)
+	case formatDelta:
+		delta, err := decompress(blob)
+		if err != nil {
+			return nil, err
+		}
+
+		_, baseContent, err := s.readObject(plumbing.AnyObject, plumbing.NewHash(base))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read delta base %s: %w", base, err)
+		}
+
+		return packfile.PatchDelta(baseContent, delta)
+	default:
+		return nil, fmt.Errorf("unknown object storage format %d", format)
+	}
+}
+
+func compress(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
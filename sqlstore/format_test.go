@@ -0,0 +1,170 @@
+package sqlstore
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// memoryStorage returns a storage that reads objects from a map in place of
+// the objects table
+func memoryStorage(objects map[plumbing.Hash]*storedObject) *Storage {
+	db := &proxy.DB{
+		QueryRowFunc: func(query string, types []string, args []interface{}) (*proxy.Row, error) {
+			var h plumbing.Hash
+			copy(h[:], args[1].([]byte))
+			o, ok := objects[h]
+
+			return &proxy.Row{ScanFunc: func(dest []interface{}) error {
+				if !ok {
+					return sql.ErrNoRows
+				}
+				base := ""
+				if o.format == formatDelta {
+					base = o.base.String()
+				}
+				*dest[0].(*int) = int(o.objType)
+				*dest[1].(*[]byte) = o.data
+				*dest[2].(*int) = o.format
+				*dest[3].(*string) = base
+				return nil
+			}}, nil
+		},
+	}
+	return &Storage{db: db}
+}
+
+func TestStoredObjectRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"empty", []byte{}},
+		{"text", []byte(`{"max": 42}`)},
+		{"repetitive", []byte(strings.Repeat(`{"name": "value", "list": [1, 2, 3]}`+"\n", 500))},
+		{"binary", []byte{0, 1, 2, 255, 254, 0, 0, 7}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := plumbing.ComputeHash(plumbing.BlobObject, test.content)
+			o, err := newStoredObject(plumbing.BlobObject, h, test.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o.format != formatZlib || o.size != int64(len(test.content)) {
+				t.Errorf("format %d size %d", o.format, o.size)
+			}
+
+			content, err := memoryStorage(nil).decode(o.format, "", o.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, test.content) {
+				t.Errorf("got %q, want %q", content, test.content)
+			}
+		})
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	config := strings.Repeat(`{"name": "value", "list": [1, 2, 3]}`+"\n", 200)
+
+	tests := []struct {
+		name string
+		// versions are stored from the first, each later one as a delta of the
+		// one before
+		versions []string
+	}{
+		{"small change", []string{config, strings.Replace(config, "value", "other", 1)}},
+		{"appended", []string{config, config + `{"added": true}` + "\n"}},
+		{"truncated", []string{config, config[:len(config)/3]}},
+		{"unrelated", []string{config, "something else entirely"}},
+		{"from empty", []string{"", config}},
+		{"to empty", []string{config, ""}},
+		{"chain", []string{
+			config,
+			strings.Replace(config, "1, 2", "1, 5", 1),
+			strings.Replace(config, "1, 2", "1, 5", 2),
+			strings.Replace(config, "1, 2", "1, 5", 2) + "tail\n",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			objects := make(map[plumbing.Hash]*storedObject)
+
+			var previous plumbing.Hash
+			for i, v := range test.versions {
+				content := []byte(v)
+				h := plumbing.ComputeHash(plumbing.BlobObject, content)
+
+				var o *storedObject
+				var err error
+				if i == 0 {
+					o, err = newStoredObject(plumbing.BlobObject, h, content)
+				} else {
+					o, err = newDeltaObject(plumbing.BlobObject, h, previous, []byte(test.versions[i-1]), content)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if o.size != int64(len(content)) {
+					t.Errorf("version %d has size %d, want %d", i, o.size, len(content))
+				}
+				objects[h] = o
+				previous = h
+			}
+
+			s := memoryStorage(objects)
+			last := test.versions[len(test.versions)-1]
+			o := objects[previous]
+			base := ""
+			if o.format == formatDelta {
+				base = o.base.String()
+			}
+
+			content, err := s.decode(o.format, base, o.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != last {
+				t.Errorf("got %d bytes, want %d", len(content), len(last))
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	content := []byte("content")
+	base := plumbing.ComputeHash(plumbing.BlobObject, []byte("base"))
+	delta, err := newDeltaObject(plumbing.BlobObject, plumbing.ComputeHash(plumbing.BlobObject, content), base, []byte("base"), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		format int
+		base   string
+		data   []byte
+	}{
+		{"unknown format", 9, "", content},
+		{"not compressed", formatZlib, "", content},
+		{"missing base", formatDelta, base.String(), delta.data},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := memoryStorage(nil).decode(test.format, test.base, test.data)
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
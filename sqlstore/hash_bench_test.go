@@ -0,0 +1,92 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/paulhatch/konfigraf/proxy"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	_ "github.com/lib/pq"
+)
+
+// benchObjects is the number of objects the repository is filled with
+const benchObjects = 20000
+
+// BenchmarkHashLookup looks up objects by hash with EncodedObject and
+// HasEncodedObject against the objects table of the extension. It needs a
+// database with the extension installed given as a connection string in
+// KONFIGRAF_TEST_DB, the repository is created in a transaction that is rolled
+// back afterwards. Only the storage API is used, so the benchmark can be run
+// against older versions of the schema to compare them.
+func BenchmarkHashLookup(b *testing.B) {
+	conn := os.Getenv("KONFIGRAF_TEST_DB")
+	if len(conn) == 0 {
+		b.Skip("KONFIGRAF_TEST_DB is not set")
+	}
+
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	name := fmt.Sprintf("hash_lookup_%d", time.Now().UnixNano())
+	if _, err := tx.Exec("SELECT create_repository($1)", name); err != nil {
+		b.Fatal(err)
+	}
+
+	s, err := NewStorage(proxy.NewSQL(tx), name)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// blobs are not cached, so every lookup reaches the database
+	hashes := make([]plumbing.Hash, benchObjects)
+	for i := range hashes {
+		obj := s.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, err := obj.Writer()
+		if err != nil {
+			b.Fatal(err)
+		}
+		fmt.Fprintf(w, "object %d", i)
+		w.Close()
+
+		hashes[i], err = s.SetEncodedObject(obj)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	if _, err := tx.Exec("ANALYZE objects"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("EncodedObject", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := s.EncodedObject(plumbing.AnyObject, hashes[i%len(hashes)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("HasEncodedObject", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := s.HasEncodedObject(hashes[i%len(hashes)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
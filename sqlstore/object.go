@@ -0,0 +1,79 @@
+package sqlstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+var errReadOnlyObject = fmt.Errorf("stored objects cannot be modified")
+
+// lazyObject is a stored object whose content is only read when it is
+// needed, listing a tree or comparing sizes for rename detection then does
+// not pull every blob from the table
+type lazyObject struct {
+	s       *Storage
+	hash    plumbing.Hash
+	objType plumbing.ObjectType
+	// size is -1 when it was not stored, it is then known once the content
+	// has been read
+	size    int64
+	content []byte
+	loaded  bool
+}
+
+func (o *lazyObject) Hash() plumbing.Hash {
+	return o.hash
+}
+
+func (o *lazyObject) Type() plumbing.ObjectType {
+	return o.objType
+}
+
+func (o *lazyObject) SetType(t plumbing.ObjectType) {
+	o.objType = t
+}
+
+func (o *lazyObject) Size() int64 {
+	if o.size < 0 {
+		if err := o.load(); err != nil {
+			return 0
+		}
+	}
+	return o.size
+}
+
+func (o *lazyObject) SetSize(size int64) {
+	o.size = size
+}
+
+func (o *lazyObject) Reader() (io.ReadCloser, error) {
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.content)), nil
+}
+
+func (o *lazyObject) Writer() (io.WriteCloser, error) {
+	return nil, errReadOnlyObject
+}
+
+// load reads the content of the object once
+func (o *lazyObject) load() error {
+	if o.loaded {
+		return nil
+	}
+
+	_, content, err := o.s.readObject(o.objType, o.hash)
+	if err != nil {
+		return err
+	}
+
+	o.content = content
+	o.size = int64(len(content))
+	o.loaded = true
+	return nil
+}
@@ -0,0 +1,204 @@
+package sqlstore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// batchSize is the number of bytes of object content buffered before a batch
+// of objects is inserted
+const batchSize = 8 << 20
+
+// PackfileWriter returns a writer for a packfile, the objects it contains are
+// written when the writer is closed. Objects are inserted in batches rather
+// than one statement per object, deltas in thin packs may refer to objects
+// that are already stored.
+func (s *Storage) PackfileWriter() (io.WriteCloser, error) {
+	return &packfileWriter{s: s}, nil
+}
+
+type packfileWriter struct {
+	s   *Storage
+	buf bytes.Buffer
+}
+
+func (w *packfileWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *packfileWriter) Close() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	batch := &objectBatch{s: w.s, pending: make(map[plumbing.Hash]plumbing.EncodedObject)}
+	scanner := packfile.NewScanner(bytes.NewReader(w.buf.Bytes()))
+	parser, err := packfile.NewParserWithStorage(scanner, batch)
+	if err != nil {
+		return err
+	}
+
+	_, err = parser.Parse()
+	if err != nil {
+		return err
+	}
+
+	return batch.flush()
+}
+
+// objectBatch collects the objects of a packfile while it is parsed, the
+// parser reads delta bases back so objects not yet inserted are served from
+// memory and anything else from the repository
+type objectBatch struct {
+	s       *Storage
+	pending map[plumbing.Hash]plumbing.EncodedObject
+	size    int
+}
+
+func (b *objectBatch) NewEncodedObject() plumbing.EncodedObject {
+	return &plumbing.MemoryObject{}
+}
+
+func (b *objectBatch) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	h := obj.Hash()
+	if _, ok := b.pending[h]; ok {
+		return h, nil
+	}
+
+	b.pending[h] = obj
+	b.size += int(obj.Size())
+	if b.size >= batchSize {
+		return h, b.flush()
+	}
+
+	return h, nil
+}
+
+func (b *objectBatch) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, ok := b.pending[h]
+	if ok && (t == plumbing.AnyObject || obj.Type() == t) {
+		return obj, nil
+	}
+	return b.s.EncodedObject(t, h)
+}
+
+func (b *objectBatch) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	return b.s.IterEncodedObjects(t)
+}
+
+func (b *objectBatch) HasEncodedObject(h plumbing.Hash) error {
+	if _, ok := b.pending[h]; ok {
+		return nil
+	}
+	return b.s.HasEncodedObject(h)
+}
+
+func (b *objectBatch) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	if obj, ok := b.pending[h]; ok {
+		return obj.Size(), nil
+	}
+	return b.s.EncodedObjectSize(h)
+}
+
+// flush inserts the pending objects
+func (b *objectBatch) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	objects := make([]*storedObject, 0, len(b.pending))
+	for h, obj := range b.pending {
+		r, err := obj.Reader()
+		if err != nil {
+			return err
+		}
+
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+
+		stored, err := newStoredObject(obj.Type(), h, content)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, stored)
+	}
+
+	err := b.s.writeObjects(objects, false)
+	if err != nil {
+		return err
+	}
+
+	b.pending = make(map[plumbing.Hash]plumbing.EncodedObject)
+	b.size = 0
+	return nil
+}
+
+// writeObjects inserts the objects with a single statement, the contents are
+// sent as one bytea with the offset and length of each object and the hashes
+// as hex since arrays of bytea cannot be passed to the extension. Existing objects are kept unless
+// replace is set, in which case their stored form is overwritten.
+func (s *Storage) writeObjects(objects []*storedObject, replace bool) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	s.write()
+	err := s.shareObjects()
+	if err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	types := make([]int64, 0, len(objects))
+	hashes := make([]string, 0, len(objects))
+	formats := make([]int64, 0, len(objects))
+	bases := make([]string, 0, len(objects))
+	sizes := make([]int64, 0, len(objects))
+	offsets := make([]int64, 0, len(objects))
+	lengths := make([]int64, 0, len(objects))
+
+	for _, obj := range objects {
+		base := ""
+		if obj.format == formatDelta {
+			base = obj.base.String()
+		}
+
+		types = append(types, int64(obj.objType))
+		hashes = append(hashes, obj.hash.String())
+		formats = append(formats, int64(obj.format))
+		bases = append(bases, base)
+		sizes = append(sizes, obj.size)
+		offsets = append(offsets, int64(data.Len()))
+		lengths = append(lengths, int64(len(obj.data)))
+		data.Write(obj.data)
+	}
+
+	conflict := "ON CONFLICT DO NOTHING"
+	if replace {
+		conflict = "ON CONFLICT ON CONSTRAINT objects_pk DO UPDATE SET blob = excluded.blob, format = excluded.format, base = excluded.base, size = excluded.size"
+	}
+
+	return s.db.Exec(
+		`INSERT INTO objects (repo_id, obj_type, hash, blob, format, base, size)
+		SELECT $1, o.obj_type, decode(o.hash, 'hex'), substring($9 FROM o.start::integer + 1 FOR o.length::integer), o.format, decode(NULLIF(o.base, ''), 'hex'), o.size
+		FROM unnest($2::bigint[], $3::text[], $4::bigint[], $5::text[], $6::bigint[], $7::bigint[], $8::bigint[]) AS o(obj_type, hash, format, base, size, start, length)
+		`+conflict,
+		[]string{"integer", "bigint[]", "text[]", "bigint[]", "text[]", "bigint[]", "bigint[]", "bigint[]", "bytea"},
+		s.repositoryID,
+		types,
+		hashes,
+		formats,
+		bases,
+		sizes,
+		offsets,
+		lengths,
+		data.Bytes())
+}
@@ -0,0 +1,127 @@
+package sqlstore
+
+import (
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// PruneResult describes the objects removed by PruneObjects
+type PruneResult struct {
+	// Deleted is the number of objects deleted
+	Deleted int
+	// Bytes is the storage used by the deleted objects
+	Bytes int64
+	// Pending is the number of unreachable objects kept because they are
+	// within the grace period or are the base of a delta
+	Pending int
+}
+
+// LockObjects waits for every transaction writing objects to the repository
+// to end and keeps others from writing any until this transaction ends.
+// Garbage collection takes it before finding the reachable objects, so an
+// existing object that another transaction has just written again, and is
+// about to reference, is either reachable by then or written anew after it
+// has been deleted.
+func (s *Storage) LockObjects() error {
+	row, err := s.db.QueryRow(
+		"SELECT count(*) FROM pg_advisory_xact_lock('objects'::regclass::oid::integer, $1)",
+		[]string{"integer"},
+		s.repositoryID)
+
+	if err != nil {
+		return err
+	}
+
+	var locked int
+	return row.Scan(&locked)
+}
+
+// shareObjects takes a share of the lock LockObjects holds before the first
+// object is written, it is held until the transaction ends
+func (s *Storage) shareObjects() error {
+	if s.shared {
+		return nil
+	}
+
+	row, err := s.db.QueryRow(
+		"SELECT count(*) FROM pg_advisory_xact_lock_shared('objects'::regclass::oid::integer, $1)",
+		[]string{"integer"},
+		s.repositoryID)
+
+	if err != nil {
+		return err
+	}
+
+	var locked int
+	err = row.Scan(&locked)
+	if err != nil {
+		return err
+	}
+
+	s.shared = true
+	return nil
+}
+
+// PruneObjects deletes every object not in the reachable set that was written
+// longer ago than the grace period, given as a Postgres interval such as
+// '1 day'. Newer objects are kept since they may belong to a transaction
+// that has not updated its reference yet, as is any object that a reachable
+// or newer object is stored as a delta of. The caller holds LockObjects.
+// Deleting objects moves the repository to a new generation, which makes
+// every backend drop the objects of the repository it has cached.
+func (s *Storage) PruneObjects(reachable []plumbing.Hash, grace string) (*PruneResult, error) {
+	hashes := make([]string, len(reachable))
+	for i, h := range reachable {
+		hashes[i] = h.String()
+	}
+
+	s.write()
+	row, err := s.db.QueryRow(
+		`WITH RECURSIVE roots(hash) AS (
+			SELECT decode(h, 'hex') FROM unnest($3::text[]) AS h
+			UNION
+			SELECT hash FROM objects WHERE repo_id = $1 AND created >= now() - $2::interval
+		), keep(hash) AS (
+			SELECT hash FROM roots
+			UNION
+			SELECT o.base FROM objects o JOIN keep k ON o.hash = k.hash
+			WHERE o.repo_id = $1 AND o.base IS NOT NULL
+		), deleted AS (
+			DELETE FROM objects
+			WHERE repo_id = $1 AND hash NOT IN (SELECT hash FROM keep)
+			RETURNING octet_length(blob) AS size
+		), bumped AS (
+			UPDATE repository SET generation = generation + 1
+			WHERE id = $1 AND EXISTS (SELECT 1 FROM deleted)
+			RETURNING 1)
+		SELECT count(*), coalesce(sum(size), 0) FROM deleted`,
+		[]string{"integer", "text", "text[]"},
+		s.repositoryID,
+		grace,
+		hashes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result PruneResult
+	err = row.Scan(&result.Deleted, &result.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Deleted > 0 {
+		objectsCache.removeRepository(s.repositoryID)
+	}
+
+	row, err = s.db.QueryRow(
+		"SELECT count(*) FROM objects WHERE repo_id = $1 AND hash NOT IN (SELECT decode(h, 'hex') FROM unnest($2::text[]) AS h)",
+		[]string{"integer", "text[]"},
+		s.repositoryID,
+		hashes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, row.Scan(&result.Pending)
+}
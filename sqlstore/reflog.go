@@ -0,0 +1,222 @@
+package sqlstore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// ReflogInfo describes why references are being changed, it is recorded with
+// every change made through the storage until it is replaced
+type ReflogInfo struct {
+	// Who made the change, the database user when empty
+	Who string
+	// Operation is a short name for the change such as commit or restore,
+	// when empty the kind of update made to the reference is used
+	Operation string
+	// Message describes the change
+	Message string
+}
+
+// ReflogEntry is a recorded movement of a reference
+type ReflogEntry struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Old is the previous target, empty when the reference was created
+	Old string `json:"old_target"`
+	// New is the new target, empty when the reference was removed
+	New       string    `json:"new_target"`
+	Who       string    `json:"who"`
+	Operation string    `json:"operation"`
+	Message   string    `json:"message"`
+	Created   time.Time `json:"created"`
+}
+
+// SetReflogInfo sets the reason recorded in the reflog for the reference
+// changes that follow
+func (s *Storage) SetReflogInfo(info ReflogInfo) {
+	s.reflog = info
+}
+
+// logReference records a change of a reference, operation is used when no
+// operation has been set with SetReflogInfo
+func (s *Storage) logReference(name string, old string, new string, operation string) error {
+	if old == new {
+		return nil
+	}
+
+	if len(s.reflog.Operation) > 0 {
+		operation = s.reflog.Operation
+	}
+
+	s.write()
+	return s.db.Exec(
+		"INSERT INTO reflog (repo_id, name, old_target, new_target, who, operation, message) VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), coalesce(NULLIF($5, ''), session_user::text), $6, $7)",
+		[]string{"integer", "text", "text", "text", "text", "text", "text"},
+		s.repositoryID,
+		name,
+		old,
+		new,
+		s.reflog.Who,
+		operation,
+		s.reflog.Message)
+}
+
+// Reflog returns the recorded changes of a reference, newest first
+func (s *Storage) Reflog(n plumbing.ReferenceName) ([]*ReflogEntry, error) {
+	return s.readReflog(
+		"SELECT coalesce(json_agg(e ORDER BY e.id DESC), '[]')::text FROM (SELECT id, name, coalesce(old_target, '') AS old_target, coalesce(new_target, '') AS new_target, who, operation, message, created FROM reflog WHERE repo_id = $1 AND name = $2) e",
+		[]string{"integer", "text"},
+		s.repositoryID,
+		n.String())
+}
+
+// ReflogEntry returns a single entry of the reflog, or nil if the repository
+// has no entry with the id
+func (s *Storage) ReflogEntry(id int64) (*ReflogEntry, error) {
+	entries, err := s.readReflog(
+		"SELECT coalesce(json_agg(e), '[]')::text FROM (SELECT id, name, coalesce(old_target, '') AS old_target, coalesce(new_target, '') AS new_target, who, operation, message, created FROM reflog WHERE repo_id = $1 AND id = $2) e",
+		[]string{"integer", "bigint"},
+		s.repositoryID,
+		id)
+
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// readReflog reads entries aggregated as JSON so that no rows is not an error
+func (s *Storage) readReflog(query string, types []string, args ...interface{}) ([]*ReflogEntry, error) {
+	row, err := s.db.QueryRow(query, types, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var data string
+	err = row.Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ReflogEntry
+	return entries, json.Unmarshal([]byte(data), &entries)
+}
+
+// ReflogTargets lists every commit a reference has pointed to according to
+// the reflog, these are kept by garbage collection so branches can be
+// restored
+func (s *Storage) ReflogTargets() ([]plumbing.Hash, error) {
+	row, err := s.db.QueryRow(
+		"SELECT coalesce(array_agg(DISTINCT t), '{}') FROM reflog, unnest(ARRAY[old_target, new_target]) AS t WHERE repo_id = $1 AND t IS NOT NULL AND t NOT LIKE 'ref: %'",
+		[]string{"integer"},
+		s.repositoryID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []string
+	err = row.Scan(&targets)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]plumbing.Hash, len(targets))
+	for i, t := range targets {
+		hashes[i] = plumbing.NewHash(t)
+	}
+	return hashes, nil
+}
+
+// RewriteReflog replaces targets recorded in the reflog, used when history has
+// been rewritten so that the reflog no longer leads to the old commits
+func (s *Storage) RewriteReflog(rewritten map[plumbing.Hash]plumbing.Hash) error {
+	old := make([]string, 0, len(rewritten))
+	new := make([]string, 0, len(rewritten))
+	for o, n := range rewritten {
+		if o != n {
+			old = append(old, o.String())
+			new = append(new, n.String())
+		}
+	}
+
+	if len(old) == 0 {
+		return nil
+	}
+
+	s.write()
+	row, err := s.db.QueryRow(
+		`WITH m AS (SELECT o, n FROM unnest($2::text[], $3::text[]) AS m(o, n)),
+		updated AS (
+			UPDATE reflog r SET
+				old_target = coalesce((SELECT n FROM m WHERE o = r.old_target), r.old_target),
+				new_target = coalesce((SELECT n FROM m WHERE o = r.new_target), r.new_target)
+			WHERE r.repo_id = $1 AND (r.old_target IN (SELECT o FROM m) OR r.new_target IN (SELECT o FROM m))
+			RETURNING 1)
+		SELECT count(*) FROM updated`,
+		[]string{"integer", "text[]", "text[]"},
+		s.repositoryID,
+		old,
+		new)
+
+	if err != nil {
+		return err
+	}
+
+	var updated int
+	return row.Scan(&updated)
+}
+
+// ExpireReflog deletes the entries older than the age, given as a Postgres
+// interval such as '90 days', so that garbage collection no longer keeps the
+// commits only they lead to. Returns the number of entries deleted.
+func (s *Storage) ExpireReflog(age string) (int, error) {
+	s.write()
+	row, err := s.db.QueryRow(
+		`WITH deleted AS (
+			DELETE FROM reflog WHERE repo_id = $1 AND created < now() - $2::interval
+			RETURNING 1)
+		SELECT count(*) FROM deleted`,
+		[]string{"integer", "text"},
+		s.repositoryID,
+		age)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	return deleted, row.Scan(&deleted)
+}
+
+// PruneReflog deletes the entries that lead to an object outside of the keep
+// set, used when history is truncated so that the reflog does not keep the
+// removed commits alive. Returns the number of entries deleted.
+func (s *Storage) PruneReflog(keep []plumbing.Hash) (int, error) {
+	hashes := make([]string, len(keep))
+	for i, h := range keep {
+		hashes[i] = h.String()
+	}
+
+	s.write()
+	row, err := s.db.QueryRow(
+		`WITH deleted AS (
+			DELETE FROM reflog r
+			WHERE r.repo_id = $1 AND EXISTS (
+				SELECT 1 FROM unnest(ARRAY[r.old_target, r.new_target]) AS t
+				WHERE t IS NOT NULL AND t NOT LIKE 'ref: %' AND t <> ALL($2::text[]))
+			RETURNING 1)
+		SELECT count(*) FROM deleted`,
+		[]string{"integer", "text[]"},
+		s.repositoryID,
+		hashes)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	return deleted, row.Scan(&deleted)
+}
@@ -0,0 +1,250 @@
+package sqlstore
+
+import (
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// maxDeltaDepth limits the number of deltas applied to read an object, the
+// same as the git default
+const maxDeltaDepth = 50
+
+// RepackResult describes the effect of Repack
+type RepackResult struct {
+	// Objects is the number of objects rewritten
+	Objects int
+	// Deltas is the number of objects now stored as a delta
+	Deltas int
+	// BytesBefore is the storage used by the repository before repacking
+	BytesBefore int64
+	// BytesAfter is the storage used by the repository after repacking
+	BytesAfter int64
+}
+
+// Repack rewrites the objects of the repository in their most compact form.
+// Each chain lists versions of the same file from newest to oldest, the
+// newest is stored whole and each older version as a delta against the next
+// newer one where that is smaller, so reading recent versions stays cheap.
+// Objects written before compression was added are compressed.
+func (s *Storage) Repack(chains [][]plumbing.Hash) (*RepackResult, error) {
+	result := &RepackResult{}
+
+	var err error
+	result.BytesBefore, err = s.storedSize()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &repackWriter{s: s, result: result, written: make(map[plumbing.Hash]bool)}
+	for _, chain := range chains {
+		err = w.chain(chain)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := s.rawObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, h := range raw {
+		if w.written[h] {
+			continue
+		}
+
+		t, content, err := s.readObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = w.add(t, h, plumbing.ZeroHash, nil, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = w.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	result.BytesAfter, err = s.storedSize()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// repackWriter batches the objects rewritten by Repack
+type repackWriter struct {
+	s       *Storage
+	result  *RepackResult
+	written map[plumbing.Hash]bool
+	pending []*storedObject
+	size    int
+}
+
+// chain stores a chain of versions, breaking it whenever the depth limit is
+// reached or a delta would not be smaller
+func (w *repackWriter) chain(chain []plumbing.Hash) error {
+	var base plumbing.Hash
+	var baseContent []byte
+	depth := 0
+
+	for _, h := range chain {
+		t, content, err := w.s.readObject(plumbing.AnyObject, h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var delta bool
+		if baseContent != nil && depth < maxDeltaDepth {
+			delta, err = w.add(t, h, base, baseContent, content)
+		} else {
+			delta, err = w.add(t, h, plumbing.ZeroHash, nil, content)
+		}
+		if err != nil {
+			return err
+		}
+
+		if delta {
+			depth++
+		} else {
+			depth = 0
+		}
+		base, baseContent = h, content
+	}
+
+	return nil
+}
+
+// add queues an object, it is stored as a delta against the base when one is
+// given and the delta is smaller than the compressed object. Returns true if
+// a delta is stored.
+func (w *repackWriter) add(t plumbing.ObjectType, h plumbing.Hash, base plumbing.Hash, baseContent []byte, content []byte) (bool, error) {
+	stored, err := newStoredObject(t, h, content)
+	if err != nil {
+		return false, err
+	}
+
+	if baseContent != nil {
+		delta, err := newDeltaObject(t, h, base, baseContent, content)
+		if err != nil {
+			return false, err
+		}
+		if len(delta.data) < len(stored.data) {
+			stored = delta
+			w.result.Deltas++
+		}
+	}
+
+	w.pending = append(w.pending, stored)
+	w.written[h] = true
+	w.result.Objects++
+	w.size += len(stored.data)
+
+	if w.size >= batchSize {
+		return stored.format == formatDelta, w.flush()
+	}
+	return stored.format == formatDelta, nil
+}
+
+func (w *repackWriter) flush() error {
+	err := w.s.writeObjects(w.pending, true)
+	if err != nil {
+		return err
+	}
+
+	w.pending = nil
+	w.size = 0
+	return nil
+}
+
+// rawObjects lists the objects stored before compression was added
+func (s *Storage) rawObjects() ([]plumbing.Hash, error) {
+	row, err := s.db.QueryRow(
+		"SELECT coalesce(array_agg(encode(hash, 'hex')), '{}') FROM objects WHERE repo_id = $1 AND format = $2",
+		[]string{"integer", "integer"},
+		s.repositoryID,
+		formatRaw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []string
+	err = row.Scan(&hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]plumbing.Hash, len(hashes))
+	for i, h := range hashes {
+		raw[i] = plumbing.NewHash(h)
+	}
+	return raw, nil
+}
+
+// storedSize is the number of bytes used to store the objects of the
+// repository
+func (s *Storage) storedSize() (int64, error) {
+	row, err := s.db.QueryRow(
+		"SELECT coalesce(sum(octet_length(blob)), 0) FROM objects WHERE repo_id = $1",
+		[]string{"integer"},
+		s.repositoryID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	return size, row.Scan(&size)
+}
+
+// InflateDeltas stores whole every object in the keep set that is stored as a
+// delta of an object outside of it, so that pruning can delete everything
+// outside the set. Returns the number of objects rewritten.
+func (s *Storage) InflateDeltas(keep []plumbing.Hash) (int, error) {
+	hashes := make([]string, len(keep))
+	for i, h := range keep {
+		hashes[i] = h.String()
+	}
+
+	row, err := s.db.QueryRow(
+		`WITH keep AS (SELECT decode(h, 'hex') AS hash FROM unnest($2::text[]) AS h)
+		SELECT coalesce(array_agg(encode(hash, 'hex')), '{}') FROM objects
+		WHERE repo_id = $1 AND base IS NOT NULL AND hash IN (SELECT hash FROM keep) AND base NOT IN (SELECT hash FROM keep)`,
+		[]string{"integer", "text[]"},
+		s.repositoryID,
+		hashes)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var deltas []string
+	err = row.Scan(&deltas)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &repackWriter{s: s, result: &RepackResult{}, written: make(map[plumbing.Hash]bool)}
+	for _, d := range deltas {
+		h := plumbing.NewHash(d)
+		t, content, err := s.readObject(plumbing.AnyObject, h)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = w.add(t, h, plumbing.ZeroHash, nil, content)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(deltas), w.flush()
+}
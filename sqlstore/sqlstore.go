@@ -20,9 +20,30 @@ import (
 
 var ErrRefHasChanged = fmt.Errorf("reference has changed concurrently")
 
+// NotifyChannel is the channel a notification is sent on whenever a reference
+// is changed, listeners receive it once the transaction commits
+const NotifyChannel = "konfigraf"
+
+// RefNotification is the JSON payload of a notification
+type RefNotification struct {
+	Repository string `json:"repository"`
+	Ref        string `json:"ref"`
+	// Target is empty when the reference was removed
+	Target string `json:"target"`
+}
+
 type Storage struct {
 	db           *proxy.DB
 	repositoryID int
+	name         string
+	reflog       ReflogInfo
+	// cached is set when the storage was opened in a transaction that had not
+	// written anything, it may use the caches until the next write
+	cached     bool
+	generation int
+	// shared is set once the transaction holds a share of the lock on the
+	// objects of the repository
+	shared bool
 }
 
 // Module returns a Storer representing a submodule, if not exists returns a
@@ -33,18 +54,45 @@ func (s *Storage) Module(name string) (storage.Storer, error) {
 
 func NewStorage(db *proxy.DB, repository string) (*Storage, error) {
 
-	row, err := db.QueryRow("SELECT id FROM repository WHERE name = $1", []string{"text"}, repository)
+	// the snapshot and statement identify when cached references are still
+	// current, the caches are not used once the transaction has written
+	row, err := db.QueryRow(
+		"SELECT id, generation, txid_current_if_assigned() IS NULL, txid_current_snapshot()::text || ' ' || statement_timestamp()::text FROM repository WHERE name = $1",
+		[]string{"text"},
+		repository)
 	if err != nil {
 		return nil, err
 	}
 
 	var repositoryID int
-	err = row.Scan(&repositoryID)
+	var generation int64
+	var readOnly bool
+	var snapshot string
+	err = row.Scan(&repositoryID, &generation, &readOnly, &snapshot)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Storage{db, repositoryID}, nil
+	s := &Storage{db: db, repositoryID: repositoryID, name: repository}
+	current := objectsCache.validate(repositoryID, generation)
+	if readOnly && current {
+		s.cached = true
+		s.generation = refsCache.validate(snapshot)
+	}
+
+	return s, nil
+}
+
+// useCache reports if the storage may read and fill the caches
+func (s *Storage) useCache() bool {
+	return s.cached && refsCache.current(s.generation)
+}
+
+// write stops the caches from being used for the rest of the transaction,
+// it is called before anything is written
+func (s *Storage) write() {
+	s.cached = false
+	refsCache.invalidate()
 }
 
 func (s *Storage) NewEncodedObject() plumbing.EncodedObject {
@@ -60,20 +108,33 @@ func (s *Storage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, e
 		return hash, err
 	}
 
-	r.Close()
+	defer r.Close()
 
 	c, err := ioutil.ReadAll(r)
 	if err != nil {
 		return hash, err
 	}
 
+	stored, err := newStoredObject(objType, hash, c)
+	if err != nil {
+		return hash, err
+	}
+
+	s.write()
+	err = s.shareObjects()
+	if err != nil {
+		return hash, err
+	}
+
 	err = s.db.Exec(
-		"INSERT INTO objects (repo_id, obj_type, hash, blob) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
-		[]string{"integer", "integer", "text", "bytea"},
+		"INSERT INTO objects (repo_id, obj_type, hash, blob, format, size) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING",
+		[]string{"integer", "integer", "bytea", "bytea", "integer", "bigint"},
 		s.repositoryID,
 		int(objType),
-		hash.String(),
-		c)
+		hash[:],
+		stored.data,
+		stored.format,
+		stored.size)
 
 	return hash, err
 }
@@ -88,49 +149,99 @@ func (s *Storage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, e
 // be looked up regardless of its type.
 func (s *Storage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
 
-	hash := h.String()
-	var objType plumbing.ObjectType
-	var content []byte
-	var err error
-
-	if t == plumbing.AnyObject {
-		row, err := s.db.QueryRow(
-			"SELECT obj_type, blob FROM objects WHERE repo_id = $1 AND hash = $2",
-			[]string{"integer", "char(40)"},
-			s.repositoryID,
-			hash)
-
-		if err != nil {
+	if cached, ok := objectsCache.get(s.repositoryID, h); ok {
+		if t != plumbing.AnyObject && cached.objType != t {
 			return nil, plumbing.ErrObjectNotFound
-			//return nil, err
 		}
+		return newObject(cached.objType, cached.content)
+	}
 
-		err = row.Scan(&objType, &content)
-	} else {
-		row, err := s.db.QueryRow(
-			"SELECT blob FROM objects WHERE repo_id = $1 AND obj_type = $2 AND hash = $3",
-			[]string{"integer", "integer", "char(40)"},
-			s.repositoryID,
-			int(t),
-			hash)
+	// the content of blobs is left for lazyObject to read when it is needed,
+	// everything else is decoded as soon as it is read
+	row, err := s.db.QueryRow(
+		"SELECT obj_type, coalesce(size, -1), CASE WHEN obj_type = $3 THEN ''::bytea ELSE blob END, format, coalesce(encode(base, 'hex'), '') FROM objects WHERE repo_id = $1 AND hash = $2",
+		[]string{"integer", "bytea", "integer"},
+		s.repositoryID,
+		h[:],
+		int(plumbing.BlobObject))
 
-		if err != nil {
-			return nil, plumbing.ErrObjectNotFound
-			//return nil, err
+	if err != nil {
+		return nil, plumbing.ErrObjectNotFound
+	}
+
+	var objType, format int
+	var size int64
+	var base string
+	var blob []byte
+	err = row.Scan(&objType, &size, &blob, &format, &base)
+	if err != nil {
+		return nil, plumbing.ErrObjectNotFound
+	}
+
+	if t != plumbing.AnyObject && plumbing.ObjectType(objType) != t {
+		return nil, plumbing.ErrObjectNotFound
+	}
+
+	if plumbing.ObjectType(objType) == plumbing.BlobObject {
+		return &lazyObject{s: s, hash: h, objType: plumbing.BlobObject, size: size}, nil
+	}
+
+	content, err := s.decode(format, base, blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.useCache() {
+		objectsCache.put(s.repositoryID, h, plumbing.ObjectType(objType), content)
+	}
+	return newObject(plumbing.ObjectType(objType), content)
+}
+
+// readObject reads and decodes the content of an object
+func (s *Storage) readObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.ObjectType, []byte, error) {
+
+	if cached, ok := objectsCache.get(s.repositoryID, h); ok {
+		if t != plumbing.AnyObject && cached.objType != t {
+			return plumbing.InvalidObject, nil, plumbing.ErrObjectNotFound
 		}
+		return cached.objType, cached.content, nil
+	}
 
-		objType = t
-		err = row.Scan(&content)
+	row, err := s.db.QueryRow(
+		"SELECT obj_type, blob, format, coalesce(encode(base, 'hex'), '') FROM objects WHERE repo_id = $1 AND hash = $2",
+		[]string{"integer", "bytea"},
+		s.repositoryID,
+		h[:])
+
+	if err != nil {
+		return plumbing.InvalidObject, nil, plumbing.ErrObjectNotFound
+		//return nil, err
 	}
 
+	var objType, format int
+	var base string
+	var blob []byte
+	err = row.Scan(&objType, &blob, &format, &base)
 	if err != nil {
 		//if err == sql.ErrNoRows {
-		return nil, plumbing.ErrObjectNotFound
+		return plumbing.InvalidObject, nil, plumbing.ErrObjectNotFound
 		//}
 		//return nil, err
 	}
 
-	return newObject(objType, []byte(content))
+	if t != plumbing.AnyObject && plumbing.ObjectType(objType) != t {
+		return plumbing.InvalidObject, nil, plumbing.ErrObjectNotFound
+	}
+
+	content, err := s.decode(format, base, blob)
+	if err != nil {
+		return plumbing.InvalidObject, nil, err
+	}
+
+	if s.useCache() {
+		objectsCache.put(s.repositoryID, h, plumbing.ObjectType(objType), content)
+	}
+	return plumbing.ObjectType(objType), content, nil
 }
 
 func newObject(t plumbing.ObjectType, content []byte) (plumbing.EncodedObject, error) {
@@ -149,16 +260,39 @@ func newObject(t plumbing.ObjectType, content []byte) (plumbing.EncodedObject, e
 func (s *Storage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
 
 	rows, err := s.db.Query(
-		"SELECT blob FROM objects WHERE repo_id = $1 AND obj_type = $2",
-		[]string{"integer", "integer"},
+		"SELECT encode(hash, 'hex'), coalesce(size, -1), CASE WHEN obj_type = $3 THEN ''::bytea ELSE blob END, format, coalesce(encode(base, 'hex'), '') FROM objects WHERE repo_id = $1 AND obj_type = $2",
+		[]string{"integer", "integer", "integer"},
 		s.repositoryID,
-		int(t))
+		int(t),
+		int(plumbing.BlobObject))
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &EncodedObjectIter{t, rows}, nil
+	// the rows are read up front since resolving a delta needs another query
+	// which cannot run while the rows are still being read
+	defer rows.Close()
+	var stored []*storedRow
+	for rows.Next() {
+		r := &storedRow{}
+		err = rows.Scan(&r.hash, &r.size, &r.blob, &r.format, &r.base)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, r)
+	}
+
+	return &EncodedObjectIter{t, s, stored}, nil
+}
+
+// storedRow is an object as it was read from the objects table
+type storedRow struct {
+	hash   string
+	size   int64
+	blob   []byte
+	format int
+	base   string
 }
 
 // HasEncodedObject returns ErrObjNotFound if the object doesn't
@@ -166,23 +300,23 @@ func (s *Storage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjec
 func (s *Storage) HasEncodedObject(h plumbing.Hash) error {
 
 	row, err := s.db.QueryRow(
-		"SELECT COUNT(*) FROM objects WHERE repo_id = $1 AND hash = $2",
-		[]string{"integer", "char(40)"},
+		"SELECT EXISTS (SELECT 1 FROM objects WHERE repo_id = $1 AND hash = $2)",
+		[]string{"integer", "bytea"},
 		s.repositoryID,
-		h.String())
+		h[:])
 
 	if err != nil {
 		return err
 	}
 
-	var r int
-	err = row.Scan(&r)
+	var exists bool
+	err = row.Scan(&exists)
 
 	if err != nil {
 		return err
 	}
 
-	if r > 0 {
+	if exists {
 		return nil
 	}
 
@@ -191,28 +325,63 @@ func (s *Storage) HasEncodedObject(h plumbing.Hash) error {
 }
 
 // EncodedObjectSize returns the plaintext size of the encoded object.
-func (s *Storage) EncodedObjectSize(plumbing.Hash) (int64, error) {
-	return 0, fmt.Errorf("not implemented")
+func (s *Storage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+
+	row, err := s.db.QueryRow(
+		"SELECT coalesce(size, -1) FROM objects WHERE repo_id = $1 AND hash = $2",
+		[]string{"integer", "bytea"},
+		s.repositoryID,
+		h[:])
+
+	if err != nil {
+		return 0, plumbing.ErrObjectNotFound
+	}
+
+	var size int64
+	err = row.Scan(&size)
+	if err != nil {
+		return 0, plumbing.ErrObjectNotFound
+	}
+
+	if size < 0 {
+		_, content, err := s.readObject(plumbing.AnyObject, h)
+		if err != nil {
+			return 0, err
+		}
+		size = int64(len(content))
+	}
+
+	return size, nil
 }
 
 type EncodedObjectIter struct {
 	t    plumbing.ObjectType
-	rows *proxy.Rows
+	s    *Storage
+	rows []*storedRow
 }
 
 func (i *EncodedObjectIter) Close() {
+	i.rows = nil
 }
 
 func (i *EncodedObjectIter) Next() (plumbing.EncodedObject, error) {
-	r := i.rows.Next()
-	if !r {
+	if len(i.rows) == 0 {
 		return nil, io.EOF
 	}
 
-	var content []byte
-	i.rows.Scan(&content)
+	r := i.rows[0]
+	i.rows = i.rows[1:]
 
-	return newObject(i.t, []byte(content))
+	if i.t == plumbing.BlobObject {
+		return &lazyObject{s: i.s, hash: plumbing.NewHash(r.hash), objType: i.t, size: r.size}, nil
+	}
+
+	content, err := i.s.decode(r.format, r.base, r.blob)
+	if err != nil {
+		return nil, err
+	}
+
+	return newObject(i.t, content)
 }
 
 func (i *EncodedObjectIter) ForEach(cb func(obj plumbing.EncodedObject) error) error {
@@ -239,36 +408,139 @@ func (i *EncodedObjectIter) ForEach(cb func(obj plumbing.EncodedObject) error) e
 func (s *Storage) SetReference(ref *plumbing.Reference) error {
 
 	raw := ref.Strings()
-	err := s.db.Exec(
+	s.write()
+
+	// the previous target is locked so the reflog records what was replaced
+	row, err := s.db.QueryRow(
+		"WITH locked AS (SELECT target FROM refs WHERE repo_id = $1 AND name = $2 FOR UPDATE) SELECT coalesce((SELECT target FROM locked), '')",
+		[]string{"integer", "text"},
+		s.repositoryID,
+		raw[0])
+
+	if err != nil {
+		return err
+	}
+
+	var old string
+	err = row.Scan(&old)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Exec(
 		"INSERT INTO refs (repo_id, name, target) VALUES ($1,$2,$3) ON CONFLICT ON CONSTRAINT refs_pk DO UPDATE SET target = $3",
 		[]string{"integer", "text", "text"},
 		s.repositoryID,
 		raw[0],
 		raw[1])
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	operation := "update"
+	if len(old) == 0 {
+		operation = "create"
+	}
+
+	err = s.logReference(raw[0], old, raw[1], operation)
+	if err != nil {
+		return err
+	}
+
+	return s.notify(raw[0], raw[1])
 }
 
 // CheckAndSetReference sets the reference `new`, but if `old` is
 // not `nil`, it first checks that the current stored value for
 // `old.Name()` matches the given reference value in `old`.  If
 // not, it returns an error and doesn't update `new`.
+//
+// The check and update are a single conditional update, a concurrent
+// transaction updating the same reference waits for this one to finish and
+// then fails the check.
 func (s *Storage) CheckAndSetReference(new, old *plumbing.Reference) error {
 	if new == nil {
 		return nil
 	}
 
-	if old != nil {
-		tmp, err := s.Reference(old.Name())
-		if err == nil || tmp.Hash() != old.Hash() {
-			return ErrRefHasChanged
-		}
+	if old == nil {
+		return s.SetReference(new)
 	}
-	return s.SetReference(new)
+
+	raw := new.Strings()
+	s.write()
+	row, err := s.db.QueryRow(
+		"WITH updated AS (UPDATE refs SET target = $3 WHERE repo_id = $1 AND name = $2 AND target = $4 RETURNING 1) SELECT count(*) FROM updated",
+		[]string{"integer", "text", "text", "text"},
+		s.repositoryID,
+		raw[0],
+		raw[1],
+		old.Strings()[1])
+
+	return s.swapped(new, old.Strings()[1], row, err)
+}
+
+// CreateReference sets a reference that must not exist yet, returning
+// ErrRefHasChanged if it does. A concurrent transaction creating the same
+// reference waits for this one to finish and then fails.
+func (s *Storage) CreateReference(ref *plumbing.Reference) error {
+	raw := ref.Strings()
+	s.write()
+	row, err := s.db.QueryRow(
+		"WITH inserted AS (INSERT INTO refs (repo_id, name, target) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING RETURNING 1) SELECT count(*) FROM inserted",
+		[]string{"integer", "text", "text"},
+		s.repositoryID,
+		raw[0],
+		raw[1])
+
+	return s.swapped(ref, "", row, err)
+}
+
+// swapped checks the result of a conditional reference update from the old
+// target, empty when the reference was created
+func (s *Storage) swapped(ref *plumbing.Reference, old string, row *proxy.Row, err error) error {
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrRefHasChanged
+	}
+
+	raw := ref.Strings()
+
+	operation := "update"
+	if len(old) == 0 {
+		operation = "create"
+	}
+
+	err = s.logReference(raw[0], old, raw[1], operation)
+	if err != nil {
+		return err
+	}
+
+	return s.notify(raw[0], raw[1])
 }
 
 func (s *Storage) Reference(n plumbing.ReferenceName) (*plumbing.Reference, error) {
 
+	cache := s.useCache()
+	if cache {
+		if ref, ok := refsCache.get(s.repositoryID, n); ok {
+			if ref == nil {
+				return nil, plumbing.ErrReferenceNotFound
+			}
+			return ref, nil
+		}
+	}
+
 	row, err := s.db.QueryRow(
 		"SELECT name, target FROM refs WHERE repo_id = $1 AND name = $2",
 		[]string{"integer", "text"},
@@ -276,6 +548,9 @@ func (s *Storage) Reference(n plumbing.ReferenceName) (*plumbing.Reference, erro
 		n.String())
 
 	if err != nil {
+		if cache {
+			refsCache.set(s.repositoryID, n, nil)
+		}
 		return nil, plumbing.ErrReferenceNotFound
 		//return nil, err
 	}
@@ -285,16 +560,30 @@ func (s *Storage) Reference(n plumbing.ReferenceName) (*plumbing.Reference, erro
 
 	if err != nil {
 		if err == sql.ErrNoRows {
+			if cache {
+				refsCache.set(s.repositoryID, n, nil)
+			}
 			return nil, plumbing.ErrReferenceNotFound
 		}
 		return nil, err
 	}
 
-	return plumbing.NewReferenceFromStrings(name, target), nil
+	ref := plumbing.NewReferenceFromStrings(name, target)
+	if cache {
+		refsCache.set(s.repositoryID, n, ref)
+	}
+	return ref, nil
 }
 
 func (s *Storage) IterReferences() (storer.ReferenceIter, error) {
 
+	cache := s.useCache()
+	if cache {
+		if refs, ok := refsCache.all(s.repositoryID); ok {
+			return storer.NewReferenceSliceIter(refs), nil
+		}
+	}
+
 	rows, err := s.db.Query(
 		"SELECT name, target FROM refs WHERE repo_id = $1",
 		[]string{"integer"},
@@ -318,18 +607,68 @@ func (s *Storage) IterReferences() (storer.ReferenceIter, error) {
 		))
 	}
 
+	if cache {
+		refsCache.setAll(s.repositoryID, refs)
+	}
 	return storer.NewReferenceSliceIter(refs), nil
 }
 
 func (s *Storage) RemoveReference(n plumbing.ReferenceName) error {
 	// TODO: Change after exec issue is solved
-	_, err := s.db.QueryRow(
-		"DELETE FROM refs WHERE repo_id = $1 and name = $2 RETURNING 1",
+	s.write()
+	row, err := s.db.QueryRow(
+		"WITH deleted AS (DELETE FROM refs WHERE repo_id = $1 and name = $2 RETURNING target) SELECT count(*), coalesce(max(target), '') FROM deleted",
 		[]string{"integer", "text"},
 		s.repositoryID,
 		n.String())
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	// the extension does not report a missing row as sql.ErrNoRows, so the
+	// deleted rows are counted instead
+	var deleted int
+	var old string
+	err = row.Scan(&deleted, &old)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return plumbing.ErrReferenceNotFound
+	}
+
+	err = s.logReference(n.String(), old, "", "delete")
+	if err != nil {
+		return err
+	}
+
+	return s.notify(n.String(), "")
+}
+
+// notify lets listeners know the reference has changed
+func (s *Storage) notify(name string, target string) error {
+	payload, err := json.Marshal(&RefNotification{
+		Repository: s.name,
+		Ref:        name,
+		Target:     target,
+	})
+	if err != nil {
+		return err
+	}
+
+	row, err := s.db.QueryRow(
+		"SELECT 1 FROM pg_notify($1, $2)",
+		[]string{"text", "text"},
+		NotifyChannel,
+		string(payload))
+
+	if err != nil {
+		return err
+	}
+
+	var r int
+	return row.Scan(&r)
 }
 
 func (s *Storage) CountLooseRefs() (int, error) {
@@ -386,6 +725,7 @@ func (s *Storage) SetConfig(c *config.Config) error {
 		return err
 	}
 
+	s.write()
 	err = s.db.Exec(
 		"INSERT INTO config (repo_id, data) VALUES ($1, $2) ON CONFLICT ON CONSTRAINT config_pk DO UPDATE SET data = $2",
 		[]string{"integer", "bytea"},
@@ -422,6 +762,7 @@ func (s *Storage) SetIndex(idx *index.Index) error {
 		return err
 	}
 
+	s.write()
 	err = s.db.Exec(
 		"INSERT INTO index (repo_id, data) VALUES ($1, $2::json) ON CONFLICT ON CONSTRAINT index_pk DO UPDATE SET data = $2::json",
 		[]string{"integer", "text"},
@@ -457,6 +798,7 @@ func (s *Storage) SetShallow(hash []plumbing.Hash) error {
 		return err
 	}
 
+	s.write()
 	err = s.db.Exec(
 		"INSERT INTO shallow (repo_id, data) VALUES ($1, $2::json) ON CONFLICT ON CONSTRAINT shallow_pk DO UPDATE SET data = $2::json",
 		[]string{"integer", "text"},